@@ -0,0 +1,474 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// command is a subcommand run instead of the exporter, for example to
+// inspect or change values on a site from the command line.
+type command struct {
+	usage string
+	run   func(ctx context.Context, fs *flag.FlagSet, args []string) error
+}
+
+var commands = map[string]command{
+	"tail": {
+		usage: "tail [-service battery] [-instance 512] [-path Dc/0/Voltage]",
+		run:   runTail,
+	},
+	"get": {
+		usage: "get <service>/<instance>/<path>",
+		run:   runGet,
+	},
+	"set": {
+		usage: "set <service>/<instance>/<path> <value>",
+		run:   runSet,
+	},
+	"replay": {
+		usage: "replay [-speed 1] <recording.jsonl.gz>",
+		run:   runReplay,
+	},
+	"mapping-stubs": {
+		usage: "mapping-stubs [-url http://127.0.0.1:9226/debug/unmapped] [-format go|yaml]",
+		run:   runMappingStubs,
+	},
+	"simulate": {
+		usage: "simulate [-listen 127.0.0.1:1883] [-speed 1]",
+		run:   runSimulate,
+	},
+}
+
+// runCommand runs the named subcommand and returns the exit status.
+func runCommand(name string, args []string) int {
+	cmd := commands[name]
+
+	fs := flag.NewFlagSet("victron-exporter "+name, flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: victron-exporter %s\n\n", cmd.usage)
+		fs.PrintDefaults()
+	}
+
+	// The connection flags are shared with the exporter
+	flag.VisitAll(func(f *flag.Flag) {
+		fs.Var(f.Value, f.Name, f.Usage)
+	})
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	err := cmd.run(ctx, fs, args)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "victron-exporter %s: %v\n", name, err)
+
+		return 1
+	}
+
+	return 0
+}
+
+// cliSession is a single mqtt connection to a site, used by the
+// subcommands.
+type cliSession struct {
+	client    mqtt.Client
+	portalID  string
+	keepalive *keepaliveState
+	messages  chan mqtt.Message
+}
+
+// openSession connects to the named site, or the first configured site
+// if name is empty, and waits for its portal ID.
+func openSession(ctx context.Context, name string) (*cliSession, error) {
+	c, err := loadConfiguration()
+	if err != nil {
+		return nil, err
+	}
+
+	sc := c.Sites[0]
+
+	if name != "" {
+		found := false
+
+		for _, candidate := range c.Sites {
+			if candidate.Name == name {
+				sc = candidate
+				found = true
+			}
+		}
+
+		if !found {
+			return nil, fmt.Errorf("unknown site %q", name)
+		}
+	}
+
+	keepalive, err := newKeepaliveState(*keepaliveMode)
+	if err != nil {
+		return nil, err
+	}
+
+	// Subcommands use the site's most preferred broker
+	b := sc.brokers()[0]
+
+	config, err := b.connectionConfig(sc.PortalID)
+	if err != nil {
+		return nil, fmt.Errorf("broker %q: %w", b.Name, err)
+	}
+
+	clientID := siteClientID(sc.Name, *clientPrefix, "cli")
+	session := &cliSession{
+		client:    mqtt.NewClient(createClientOptions(sc.Name, clientID, config, *connectTimeout, nil)),
+		keepalive: keepalive,
+		messages:  make(chan mqtt.Message, 100),
+	}
+
+	connectCtx, cancel := context.WithTimeout(ctx, *connectTimeout)
+	defer cancel()
+
+	err = connectWait(connectCtx, session.client, *connectTimeout)
+	if err != nil {
+		return nil, fmt.Errorf("broker %s: %w", b.Name, err)
+	}
+
+	session.portalID = sc.PortalID
+	if session.portalID != "" {
+		return session, nil
+	}
+
+	serials := make(chan string, 1)
+
+	err = session.subscribe(connectCtx, "N/+/system/0/Serial", func(client mqtt.Client, msg mqtt.Message) {
+		select {
+		case serials <- strings.Split(msg.Topic(), "/")[1]:
+		default:
+		}
+	})
+	if err != nil {
+		session.close()
+
+		return nil, err
+	}
+
+	select {
+	case session.portalID = <-serials:
+		return session, nil
+	case <-connectCtx.Done():
+		session.close()
+
+		return nil, fmt.Errorf("awaiting portal ID from Victron mqtt bus: %w", connectCtx.Err())
+	}
+}
+
+func (c *cliSession) close() {
+	c.client.Disconnect(250)
+}
+
+// subscribe subscribes to topic, passing messages to handler, or to the
+// messages channel when handler is nil.
+func (c *cliSession) subscribe(ctx context.Context, topic string, handler mqtt.MessageHandler) error {
+	if handler == nil {
+		handler = func(client mqtt.Client, msg mqtt.Message) {
+			c.messages <- msg
+		}
+	}
+
+	return c.wait(ctx, c.client.Subscribe(topic, 0, handler))
+}
+
+func (c *cliSession) publish(ctx context.Context, topic string, payload string) error {
+	return c.wait(ctx, c.client.Publish(topic, 1, false, payload))
+}
+
+func (c *cliSession) wait(ctx context.Context, token mqtt.Token) error {
+	select {
+	case <-token.Done():
+		return token.Error()
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// cliMessage is an N/ message split into its parts for display.
+type cliMessage struct {
+	service  string
+	instance string
+	path     string
+	value    interface{}
+	ok       bool
+}
+
+func parseCLIMessage(msg mqtt.Message) cliMessage {
+	parts := strings.SplitN(msg.Topic(), "/", 5)
+	if len(parts) < 5 {
+		return cliMessage{path: msg.Topic()}
+	}
+
+	m := cliMessage{service: parts[2], instance: parts[3], path: parts[4]}
+
+	var v struct {
+		Value interface{} `json:"value"`
+	}
+
+	m.ok = json.Unmarshal(msg.Payload(), &v) == nil
+	m.value = v.Value
+
+	return m
+}
+
+func (m cliMessage) key() string {
+	if m.service == "" {
+		return m.path
+	}
+
+	return m.service + "/" + m.instance + "/" + m.path
+}
+
+// String formats the message as "service/instance/path = value".
+func (m cliMessage) String() string {
+	if !m.ok {
+		return m.key() + " (invalid payload)"
+	}
+
+	return m.key() + " = " + formatCLIValue(m.value)
+}
+
+func formatCLIValue(v interface{}) string {
+	switch v := v.(type) {
+	case nil:
+		return "null"
+	case float64:
+		return fmt.Sprintf("%g", v)
+	case string:
+		return fmt.Sprintf("%q", v)
+	default:
+		b, err := json.Marshal(v)
+		if err != nil {
+			return fmt.Sprint(v)
+		}
+
+		return string(b)
+	}
+}
+
+// parseCLIKey checks that key has the form service/instance/path.
+func parseCLIKey(key string) error {
+	parts := strings.SplitN(key, "/", 3)
+	if len(parts) < 3 || parts[0] == "" || parts[1] == "" || parts[2] == "" {
+		return fmt.Errorf("expected <service>/<instance>/<path>, got %q", key)
+	}
+
+	return nil
+}
+
+// runTail prints every update received from the site until interrupted,
+// sending keepalives so that the GX keeps publishing.
+func runTail(ctx context.Context, fs *flag.FlagSet, args []string) error {
+	siteName := fs.String("site", "", "Site to connect to. Defaults to the first site")
+	service := fs.String("service", "+", "Only show this service, for example battery or vebus")
+	instance := fs.String("instance", "+", "Only show this device instance")
+	path := fs.String("path", "", "Only show paths starting with this prefix")
+
+	err := fs.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	setLogLevel(*logLevel)
+
+	session, err := openSession(ctx, *siteName)
+	if err != nil {
+		return err
+	}
+	defer session.close()
+
+	prefix := "N/" + session.portalID + "/"
+
+	err = session.subscribe(ctx, prefix+*service+"/"+*instance+"/#", nil)
+	if err != nil {
+		return err
+	}
+
+	err = session.subscribe(ctx, prefix+"full_publish_completed", func(client mqtt.Client, msg mqtt.Message) {
+		session.keepalive.fullPublishCompleted()
+	})
+	if err != nil {
+		return err
+	}
+
+	ticker := time.NewTicker(*pollInterval)
+	defer ticker.Stop()
+
+	for {
+		topic, payload := session.keepalive.nextRequest(session.portalID)
+
+		err := session.publish(ctx, topic, payload)
+		if err != nil {
+			return err
+		}
+
+	printing:
+		for {
+			select {
+			case <-ctx.Done():
+				return nil
+			case <-ticker.C:
+				break printing
+			case msg := <-session.messages:
+				m := parseCLIMessage(msg)
+				if strings.HasPrefix(m.path, *path) {
+					fmt.Printf("%s %s\n", time.Now().Format("15:04:05.000"), m)
+				}
+			}
+		}
+	}
+}
+
+// runGet prints the current value of a single path.
+func runGet(ctx context.Context, fs *flag.FlagSet, args []string) error {
+	siteName := fs.String("site", "", "Site to connect to. Defaults to the first site")
+	timeout := fs.Duration("timeout", 10*time.Second, "Time to wait for the value")
+
+	err := fs.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	if fs.NArg() != 1 {
+		fs.Usage()
+
+		return errors.New("expected a single path")
+	}
+
+	key := fs.Arg(0)
+
+	err = parseCLIKey(key)
+	if err != nil {
+		return err
+	}
+
+	setLogLevel(*logLevel)
+
+	session, err := openSession(ctx, *siteName)
+	if err != nil {
+		return err
+	}
+	defer session.close()
+
+	ctx, cancel := context.WithTimeout(ctx, *timeout)
+	defer cancel()
+
+	err = session.subscribe(ctx, "N/"+session.portalID+"/"+key, nil)
+	if err != nil {
+		return err
+	}
+
+	err = session.publish(ctx, "R/"+session.portalID+"/"+key, "")
+	if err != nil {
+		return err
+	}
+
+	select {
+	case msg := <-session.messages:
+		fmt.Println(parseCLIMessage(msg))
+
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("no value received for %s: %w", key, ctx.Err())
+	}
+}
+
+// runSet writes a value to a path and waits for the GX to confirm it, as
+// the write API does.
+func runSet(ctx context.Context, fs *flag.FlagSet, args []string) error {
+	siteName := fs.String("site", "", "Site to connect to. Defaults to the first site")
+	timeout := fs.Duration("timeout", 10*time.Second, "Time to wait for the GX to confirm the value")
+
+	err := fs.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	if fs.NArg() != 2 {
+		fs.Usage()
+
+		return errors.New("expected a path and a value")
+	}
+
+	key := fs.Arg(0)
+
+	err = parseCLIKey(key)
+	if err != nil {
+		return err
+	}
+
+	// Values are JSON, so that strings and arrays can be written too.
+	// Anything that isn't valid JSON is written as a string.
+	var value interface{}
+
+	decoder := json.NewDecoder(bytes.NewBufferString(fs.Arg(1)))
+	if decoder.Decode(&value) != nil || decoder.More() {
+		value = fs.Arg(1)
+	}
+
+	payload, err := json.Marshal(map[string]interface{}{"value": value})
+	if err != nil {
+		return err
+	}
+
+	setLogLevel(*logLevel)
+
+	session, err := openSession(ctx, *siteName)
+	if err != nil {
+		return err
+	}
+	defer session.close()
+
+	ctx, cancel := context.WithTimeout(ctx, *timeout)
+	defer cancel()
+
+	err = session.subscribe(ctx, "N/"+session.portalID+"/"+key, nil)
+	if err != nil {
+		return err
+	}
+
+	err = publishWrite(ctx, session.client, session.portalID, key, payload)
+	if err != nil {
+		return err
+	}
+
+	for {
+		select {
+		case msg := <-session.messages:
+			if writeConfirmed(msg.Payload(), value) {
+				fmt.Println(parseCLIMessage(msg))
+
+				return nil
+			}
+		case <-ctx.Done():
+			return fmt.Errorf("%s was not confirmed: %w", key, ctx.Err())
+		}
+	}
+}
+
+// commandNames returns the subcommands in alphabetical order.
+func commandNames() []string {
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	return names
+}
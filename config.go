@@ -0,0 +1,414 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// defaultSiteName is used for the site configured through command line
+// flags when no configuration file is given.
+const defaultSiteName = "default"
+
+// brokerSettings are the settings for connecting to an mqtt broker.
+type brokerSettings struct {
+	Host     string `yaml:"host"`
+	Port     int    `yaml:"port"`
+	Secure   *bool  `yaml:"secure"`
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+	// PasswordFile is read into Password, so that it can be kept out of
+	// the config file
+	PasswordFile string       `yaml:"password_file"`
+	TLS          *tlsSettings `yaml:"tls"`
+	// URL overrides Host, Port and Secure, for example
+	// wss://mqtt21.victronenergy.com/mqtt to connect over websockets
+	URL     string            `yaml:"url"`
+	Headers map[string]string `yaml:"headers"`
+	// AccessToken is a VRM personal access token, used instead of Password
+	AccessToken     string `yaml:"access_token"`
+	AccessTokenFile string `yaml:"access_token_file"`
+	// VRMLogin obtains credentials by logging in to the VRM API with
+	// Username and Password, refreshing them as they expire
+	VRMLogin  *bool  `yaml:"vrm_login"`
+	VRMAPIURL string `yaml:"vrm_api_url"`
+}
+
+type brokerConfig struct {
+	Name           string `yaml:"name"`
+	brokerSettings `yaml:",inline"`
+}
+
+type siteConfig struct {
+	Name     string `yaml:"name"`
+	PortalID string `yaml:"portal_id"`
+	// The site's broker, and defaults for Brokers
+	brokerSettings `yaml:",inline"`
+	// Brokers lists the brokers to use in order of preference. The site
+	// fails over to the next broker when one becomes unavailable.
+	Brokers []brokerConfig `yaml:"brokers"`
+}
+
+type httpConfig struct {
+	ListenAddress   string        `yaml:"listen_address"`
+	ReadyMaxDataAge time.Duration `yaml:"ready_max_data_age"`
+}
+
+type config struct {
+	HTTP     httpConfig      `yaml:"http"`
+	Sites    []siteConfig    `yaml:"sites"`
+	Mappings []mappingConfig `yaml:"mappings"`
+	Filters  filtersConfig   `yaml:"filters"`
+}
+
+var errNoSites = errors.New("no sites configured")
+
+// loadConfig reads the configuration file at path. Settings that a site
+// leaves out are taken from defaults, which is built from the command
+// line flags, as are HTTP settings from defaultHTTP.
+func loadConfig(path string, defaults siteConfig, defaultHTTP httpConfig) (*config, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config file: %w", err)
+	}
+
+	var c config
+
+	err = yaml.Unmarshal(b, &c)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse config file %s: %w", path, err)
+	}
+
+	if c.HTTP.ListenAddress == "" {
+		c.HTTP.ListenAddress = defaultHTTP.ListenAddress
+	}
+
+	if c.HTTP.ReadyMaxDataAge == 0 {
+		c.HTTP.ReadyMaxDataAge = defaultHTTP.ReadyMaxDataAge
+	}
+
+	for i := range c.Sites {
+		c.Sites[i].applyDefaults(defaults)
+
+		err = c.Sites[i].readSecrets()
+		if err != nil {
+			return nil, fmt.Errorf("site %q: %w", c.Sites[i].Name, err)
+		}
+	}
+
+	return &c, c.validate()
+}
+
+// secretFiles returns the files that the sites' secrets are read from.
+func (c *config) secretFiles() []string {
+	var files []string
+
+	seen := map[string]bool{}
+
+	for _, s := range c.Sites {
+		settings := []brokerSettings{s.brokerSettings}
+		for _, b := range s.Brokers {
+			settings = append(settings, b.brokerSettings)
+		}
+
+		for _, b := range settings {
+			for _, path := range []string{b.PasswordFile, b.AccessTokenFile} {
+				if path != "" && !seen[path] {
+					seen[path] = true
+					files = append(files, path)
+				}
+			}
+		}
+	}
+
+	return files
+}
+
+// readSecrets reads secrets that the site's brokers keep in files.
+func (s *siteConfig) readSecrets() error {
+	err := s.brokerSettings.readSecrets()
+	if err != nil {
+		return err
+	}
+
+	for i := range s.Brokers {
+		err := s.Brokers[i].readSecrets()
+		if err != nil {
+			return fmt.Errorf("broker %q: %w", s.Brokers[i].Name, err)
+		}
+	}
+
+	return nil
+}
+
+func (b *brokerSettings) readSecrets() error {
+	if b.PasswordFile != "" {
+		password, err := readSecretFile(b.PasswordFile)
+		if err != nil {
+			return err
+		}
+
+		b.Password = password
+	}
+
+	if b.AccessTokenFile != "" {
+		token, err := readSecretFile(b.AccessTokenFile)
+		if err != nil {
+			return err
+		}
+
+		b.AccessToken = token
+	}
+
+	return nil
+}
+
+func readSecretFile(path string) (string, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to read secret: %w", err)
+	}
+
+	return strings.TrimSpace(string(b)), nil
+}
+
+func (s *siteConfig) applyDefaults(defaults siteConfig) {
+	// Sites with a portal ID but no host connect to their VRM broker
+	if s.URL == "" && s.Host == "" && s.PortalID == "" && len(s.Brokers) == 0 {
+		s.URL = defaults.URL
+		s.Host = defaults.Host
+	}
+
+	s.brokerSettings.applyDefaults(defaults.brokerSettings)
+
+	for i := range s.Brokers {
+		s.Brokers[i].applyDefaults(s.brokerDefaults(s.Brokers[i].brokerSettings))
+	}
+}
+
+// brokerDefaults returns the settings that broker b takes from the site.
+// Brokers without a host or url connect to the site's VRM broker and share
+// all of its settings. Brokers with their own address don't get the VRM
+// access token, login or headers, nor the username and password unless
+// the site has its own address too, so that VRM credentials aren't sent
+// to a broker on the local network.
+func (s *siteConfig) brokerDefaults(b brokerSettings) brokerSettings {
+	defaults := s.brokerSettings
+
+	if b.Host == "" && b.URL == "" {
+		return defaults
+	}
+
+	defaults.AccessToken, defaults.AccessTokenFile = "", ""
+	defaults.VRMLogin = nil
+	defaults.Headers = nil
+
+	if s.Host == "" && s.URL == "" {
+		defaults.Username = ""
+		defaults.Password, defaults.PasswordFile = "", ""
+	}
+
+	return defaults
+}
+
+func (b *brokerSettings) applyDefaults(defaults brokerSettings) {
+	// Logging in to VRM replaces the broker's own credentials, so it is
+	// only inherited by brokers that have none
+	ownCredentials := b.Password != "" || b.PasswordFile != "" || b.AccessToken != "" || b.AccessTokenFile != ""
+
+	if b.VRMLogin == nil && !ownCredentials {
+		b.VRMLogin = defaults.VRMLogin
+	}
+
+	if b.Port == 0 {
+		b.Port = defaults.Port
+	}
+
+	if b.Secure == nil {
+		b.Secure = defaults.Secure
+	}
+
+	if b.Username == "" {
+		b.Username = defaults.Username
+	}
+
+	if b.Password == "" && b.PasswordFile == "" {
+		b.Password = defaults.Password
+		b.PasswordFile = defaults.PasswordFile
+	}
+
+	if b.TLS == nil {
+		b.TLS = defaults.TLS
+	}
+
+	if b.AccessToken == "" && b.AccessTokenFile == "" && !b.vrmLogin() {
+		b.AccessToken = defaults.AccessToken
+		b.AccessTokenFile = defaults.AccessTokenFile
+	}
+
+	if b.Headers == nil {
+		b.Headers = defaults.Headers
+	}
+
+	if b.VRMAPIURL == "" {
+		b.VRMAPIURL = defaults.VRMAPIURL
+	}
+}
+
+func (c *config) validate() error {
+	if len(c.Sites) == 0 {
+		return errNoSites
+	}
+
+	names := map[string]bool{}
+
+	for _, s := range c.Sites {
+		if s.Name == "" {
+			return fmt.Errorf("site with host %q has no name", s.Host)
+		}
+
+		if names[s.Name] {
+			return fmt.Errorf("duplicate site name %q", s.Name)
+		}
+		names[s.Name] = true
+
+		brokerNames := map[string]bool{}
+
+		for _, b := range s.brokers() {
+			if b.URL == "" && b.Host == "" && s.PortalID == "" {
+				if len(s.Brokers) == 0 {
+					return fmt.Errorf("site %q has no broker url, host or VRM portal ID", s.Name)
+				}
+
+				return fmt.Errorf("site %q broker %q has no url, host or VRM portal ID", s.Name, b.Name)
+			}
+
+			if err := b.validateAuth(); err != nil {
+				return fmt.Errorf("site %q broker %q: %w", s.Name, b.Name, err)
+			}
+
+			if brokerNames[b.Name] {
+				return fmt.Errorf("site %q has duplicate broker name %q", s.Name, b.Name)
+			}
+			brokerNames[b.Name] = true
+		}
+	}
+
+	err := validateMappings(c.Mappings)
+	if err != nil {
+		return err
+	}
+
+	_, err = newSeriesFilter(c.Filters)
+	if err != nil {
+		return fmt.Errorf("filters: %w", err)
+	}
+
+	return nil
+}
+
+func (b brokerSettings) vrmLogin() bool {
+	return b.VRMLogin != nil && *b.VRMLogin
+}
+
+func (b brokerSettings) validateAuth() error {
+	if b.AccessToken != "" && b.vrmLogin() {
+		return errors.New("access_token and vrm_login cannot both be set")
+	}
+
+	if b.vrmLogin() && (b.Username == "" || b.Password == "") {
+		return errors.New("vrm_login requires a username and password")
+	}
+
+	return nil
+}
+
+// brokers returns the site's brokers in order of preference.
+func (s siteConfig) brokers() []brokerConfig {
+	brokers := s.Brokers
+	if len(brokers) == 0 {
+		brokers = []brokerConfig{{brokerSettings: s.brokerSettings}}
+	}
+
+	named := make([]brokerConfig, 0, len(brokers))
+
+	for _, b := range brokers {
+		if b.Name == "" {
+			b.Name = b.defaultName()
+		}
+
+		named = append(named, b)
+	}
+
+	return named
+}
+
+func (b brokerSettings) defaultName() string {
+	switch {
+	case b.URL != "":
+		return b.URL
+	case b.Host != "":
+		return b.Host
+	default:
+		return "vrm"
+	}
+}
+
+// connectionConfig returns the connection configuration for the broker.
+// portalID selects the VRM broker when no host or url is given.
+func (b brokerSettings) connectionConfig(portalID string) (mqttConnectionConfig, error) {
+	c := mqttConnectionConfig{
+		host:        b.Host,
+		port:        b.Port,
+		secure:      b.Secure != nil && *b.Secure,
+		username:    b.Username,
+		password:    b.Password,
+		vrmPortalID: portalID,
+	}
+
+	switch {
+	case b.AccessToken != "":
+		c.password = vrmAccessTokenPassword(b.AccessToken)
+	case b.vrmLogin():
+		c.credentials = newVRMLogin(b.VRMAPIURL, b.Username, b.Password).credentials
+	}
+
+	if b.URL != "" {
+		u, err := parseBrokerURL(b.URL)
+		if err != nil {
+			return c, err
+		}
+
+		c.url = u
+	}
+
+	if len(b.Headers) > 0 {
+		c.headers = http.Header{}
+		for k, v := range b.Headers {
+			c.headers.Set(k, v)
+		}
+	}
+
+	if !c.usesTLS() {
+		return c, nil
+	}
+
+	var settings tlsSettings
+	if b.TLS != nil {
+		settings = *b.TLS
+	}
+
+	tlsConfig, err := newTLSConfig(settings, c.brokerHost())
+	if err != nil {
+		return c, err
+	}
+
+	c.tlsConfig = tlsConfig
+
+	return c, nil
+}
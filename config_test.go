@@ -0,0 +1,164 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// loadTestConfig loads a config file with the given contents.
+func loadTestConfig(t *testing.T, contents string, defaults siteConfig) (*config, error) {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "config.yaml")
+
+	err := os.WriteFile(path, []byte(contents), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return loadConfig(path, defaults, httpConfig{})
+}
+
+func TestVRMLoginDefault(t *testing.T) {
+	enabled := true
+	defaults := siteConfig{brokerSettings: brokerSettings{
+		Username: "me@example.com",
+		Password: "secret",
+		VRMLogin: &enabled,
+	}}
+
+	c, err := loadTestConfig(t, `
+sites:
+  - name: inherited
+    portal_id: c0619ab12345
+  - name: opted-out
+    portal_id: c0619ab12346
+    vrm_login: false
+  - name: token
+    portal_id: c0619ab12347
+    access_token: abc123
+  - name: lan
+    host: 192.168.1.20
+    password: lan-secret
+`, defaults)
+	if err != nil {
+		t.Fatalf("loadConfig() error = %v", err)
+	}
+
+	want := map[string]bool{
+		"inherited": true,
+		"opted-out": false,
+		"token":     false,
+		"lan":       false,
+	}
+
+	for _, s := range c.Sites {
+		if got := s.vrmLogin(); got != want[s.Name] {
+			t.Errorf("site %q: vrm login = %t, want %t", s.Name, got, want[s.Name])
+		}
+	}
+}
+
+func TestVRMLoginWithDefaultAccessToken(t *testing.T) {
+	defaults := siteConfig{brokerSettings: brokerSettings{AccessToken: "abc123"}}
+
+	c, err := loadTestConfig(t, `
+sites:
+  - name: login
+    portal_id: c0619ab12345
+    username: me@example.com
+    password: secret
+    vrm_login: true
+`, defaults)
+	if err != nil {
+		t.Fatalf("loadConfig() error = %v", err)
+	}
+
+	if c.Sites[0].AccessToken != "" {
+		t.Errorf("site with vrm_login inherited the access token")
+	}
+}
+
+func TestBrokerDefaults(t *testing.T) {
+	c, err := loadTestConfig(t, `
+sites:
+  - name: boat
+    portal_id: c0619ab12345
+    port: 8883
+    username: me@example.com
+    password: secret
+    headers:
+      X-Test: vrm
+    brokers:
+      - name: local
+        host: 192.168.1.20
+      - name: vrm
+  - name: lan
+    host: 192.168.1.20
+    username: lan-user
+    password: lan-secret
+    brokers:
+      - name: primary
+        host: 192.168.1.20
+      - name: backup
+        host: 192.168.1.21
+`, siteConfig{})
+	if err != nil {
+		t.Fatalf("loadConfig() error = %v", err)
+	}
+
+	tests := []struct {
+		site     int
+		broker   int
+		username string
+		password string
+		headers  bool
+	}{
+		{0, 0, "", "", false},
+		{0, 1, "me@example.com", "secret", true},
+		{1, 0, "lan-user", "lan-secret", false},
+		{1, 1, "lan-user", "lan-secret", false},
+	}
+
+	for _, tt := range tests {
+		s := c.Sites[tt.site]
+		b := s.Brokers[tt.broker]
+
+		if b.Username != tt.username || b.Password != tt.password || (b.Headers != nil) != tt.headers {
+			t.Errorf("site %q broker %q: username %q, password %q, headers %v, want %q, %q, headers %t",
+				s.Name, b.Name, b.Username, b.Password, b.Headers, tt.username, tt.password, tt.headers)
+		}
+
+		if b.Port != 8883 && tt.site == 0 {
+			t.Errorf("site %q broker %q: port %d, want the site's port", s.Name, b.Name, b.Port)
+		}
+	}
+}
+
+func TestConfigValidateSites(t *testing.T) {
+	tests := []struct {
+		sites string
+		err   string
+	}{
+		{"[]", "no sites configured"},
+		{"\n  - host: 192.168.1.20", "has no name"},
+		{"\n  - name: boat\n    host: 192.168.1.20\n  - name: boat\n    host: 192.168.1.21", "duplicate site name"},
+		{"\n  - name: boat", "has no broker url, host or VRM portal ID"},
+		{"\n  - name: boat\n    brokers:\n      - name: local", "broker \"local\" has no url"},
+		{"\n  - name: boat\n    brokers:\n      - host: 192.168.1.20\n      - host: 192.168.1.20", "duplicate broker name"},
+		{"\n  - name: boat\n    host: 192.168.1.20\n  - name: home\n    portal_id: c0619ab12345", ""},
+	}
+
+	for _, tt := range tests {
+		_, err := loadTestConfig(t, "sites: "+tt.sites+"\n", siteConfig{})
+
+		switch {
+		case tt.err == "" && err != nil:
+			t.Errorf("sites %s: loadConfig() error = %v", tt.sites, err)
+		case tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)):
+			t.Errorf("sites %s: loadConfig() error = %v, want %q", tt.sites, err, tt.err)
+		}
+	}
+}
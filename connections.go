@@ -0,0 +1,50 @@
+package main
+
+import (
+	"strings"
+	"sync"
+	"time"
+)
+
+// connectionStates tracks whether each mqtt client is connected. It
+// backs the connectionStatus metrics and the readiness check.
+type connectionStates struct {
+	mu     sync.RWMutex
+	states map[string]bool
+}
+
+var connections = &connectionStates{states: map[string]bool{}}
+
+func (c *connectionStates) set(siteName string, clientID string, connected bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.states[siteName+"/"+clientID] = connected
+
+	status := 0.0
+	if connected {
+		status = 1
+	}
+
+	connectionStatus.WithLabelValues(siteName, clientID).Set(status)
+	connectionStatusSinceTimeSeconds.WithLabelValues(siteName, clientID).Set(float64(time.Now().Unix()))
+}
+
+func (c *connectionStates) connected(siteName string, clientID string) bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	return c.states[siteName+"/"+clientID]
+}
+
+// deleteSite forgets the connection states of a site that has been removed.
+func (c *connectionStates) deleteSite(siteName string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for key := range c.states {
+		if strings.HasPrefix(key, siteName+"/") {
+			delete(c.states, key)
+		}
+	}
+}
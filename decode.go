@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+)
+
+// Shapes of the values that Venus publishes
+const (
+	shapeNumber = "number"
+	shapeNull   = "null"
+	shapeBool   = "bool"
+	shapeString = "string"
+	shapeArray  = "array"
+	shapeObject = "object"
+)
+
+// payloadValue is the decoded value of an N/ message.
+type payloadValue struct {
+	shape string
+	// value is set for numbers and booleans, and is NaN for null
+	value float64
+	// elements holds the numeric and boolean elements of an array or
+	// object, keyed by index or key. Other elements are left out.
+	elements map[string]float64
+}
+
+// decodePayload decodes a {"value": ...} payload of any shape.
+func decodePayload(payload []byte) (payloadValue, error) {
+	var envelope struct {
+		Value json.RawMessage `json:"value"`
+	}
+
+	err := json.Unmarshal(payload, &envelope)
+	if err != nil {
+		return payloadValue{}, err
+	}
+
+	raw := bytes.TrimSpace(envelope.Value)
+	if len(raw) == 0 {
+		// No value at all is treated like null
+		return payloadValue{shape: shapeNull, value: math.NaN()}, nil
+	}
+
+	switch raw[0] {
+	case '[':
+		var elements []json.RawMessage
+
+		err := json.Unmarshal(raw, &elements)
+		if err != nil {
+			return payloadValue{}, err
+		}
+
+		v := payloadValue{shape: shapeArray, elements: map[string]float64{}}
+
+		for i, element := range elements {
+			if f, ok := decodeScalar(element); ok {
+				v.elements[strconv.Itoa(i)] = f
+			}
+		}
+
+		return v, nil
+	case '{':
+		var elements map[string]json.RawMessage
+
+		err := json.Unmarshal(raw, &elements)
+		if err != nil {
+			return payloadValue{}, err
+		}
+
+		v := payloadValue{shape: shapeObject, elements: map[string]float64{}}
+
+		for key, element := range elements {
+			if f, ok := decodeScalar(element); ok {
+				v.elements[key] = f
+			}
+		}
+
+		return v, nil
+	case '"':
+		return payloadValue{shape: shapeString}, nil
+	}
+
+	f, ok := decodeScalar(raw)
+	if !ok {
+		return payloadValue{}, fmt.Errorf("unexpected value %s", raw)
+	}
+
+	switch raw[0] {
+	case 'n':
+		return payloadValue{shape: shapeNull, value: f}, nil
+	case 't', 'f':
+		return payloadValue{shape: shapeBool, value: f}, nil
+	default:
+		return payloadValue{shape: shapeNumber, value: f}, nil
+	}
+}
+
+// decodeScalar decodes a number, boolean or null, mapping booleans to 0
+// and 1 and null to NaN.
+func decodeScalar(raw json.RawMessage) (float64, bool) {
+	switch string(raw) {
+	case "null":
+		return math.NaN(), true
+	case "true":
+		return 1, true
+	case "false":
+		return 0, true
+	}
+
+	var f float64
+
+	err := json.Unmarshal(raw, &f)
+
+	return f, err == nil
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+)
+
+func TestDecodePayload(t *testing.T) {
+	tests := []struct {
+		payload  string
+		shape    string
+		value    float64
+		elements map[string]float64
+	}{
+		{`{"value": 52.1}`, shapeNumber, 52.1, nil},
+		{`{"value": null}`, shapeNull, math.NaN(), nil},
+		{`{}`, shapeNull, math.NaN(), nil},
+		{`{"value": true}`, shapeBool, 1, nil},
+		{`{"value": false}`, shapeBool, 0, nil},
+		{`{"value": "MultiPlus-II"}`, shapeString, 0, nil},
+		// Nested and string elements are left out
+		{`{"value": [1, null, true, "x", [2], {"a": 3}]}`, shapeArray, 0, map[string]float64{"0": 1, "1": math.NaN(), "2": 1}},
+		{`{"value": {"a": 1, "b": false, "c": [2], "d": {"e": 3}}}`, shapeObject, 0, map[string]float64{"a": 1, "b": 0}},
+		{`{"value": []}`, shapeArray, 0, map[string]float64{}},
+	}
+
+	for _, tt := range tests {
+		v, err := decodePayload([]byte(tt.payload))
+		if err != nil {
+			t.Errorf("decodePayload(%s) error = %v", tt.payload, err)
+
+			continue
+		}
+
+		if v.shape != tt.shape || !sameFloat(v.value, tt.value) || !sameElements(v.elements, tt.elements) {
+			t.Errorf("decodePayload(%s) = %s %g %v, want %s %g %v", tt.payload, v.shape, v.value, v.elements, tt.shape, tt.value, tt.elements)
+		}
+	}
+}
+
+func TestDecodePayloadErrors(t *testing.T) {
+	for _, payload := range []string{``, `not json`, `{"value": 1`, `{"value": nul}`, `{"value": [1,}`} {
+		_, err := decodePayload([]byte(payload))
+		if err == nil {
+			t.Errorf("decodePayload(%s) succeeded, want an error", payload)
+		}
+	}
+}
+
+func sameFloat(a float64, b float64) bool {
+	return a == b || (math.IsNaN(a) && math.IsNaN(b))
+}
+
+func sameElements(a map[string]float64, b map[string]float64) bool {
+	if len(a) != len(b) || (a == nil) != (b == nil) {
+		return false
+	}
+
+	for k, v := range a {
+		w, ok := b[k]
+		if !ok || !sameFloat(v, w) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// TestHandleMessageShapes checks how values of each shape are exported
+// and counted.
+func TestHandleMessageShapes(t *testing.T) {
+	s := newTestSite(t, "decode", "tcp://127.0.0.1:1")
+
+	elements := prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "test_elements"}, append(append([]string{}, labels...), "key"))
+	elementTopicMap["Test/Elements"] = mqttElementObserver{
+		name:      "test_elements",
+		collector: newTimestampedVec(elements, append(append([]string{}, labels...), "key")),
+		observe: func(site string, portalID string, componentType string, componentID string, key string, value float64) {
+			elements.WithLabelValues(site, portalID, componentType, componentID, key).Set(value)
+		},
+	}
+	defer delete(elementTopicMap, "Test/Elements")
+
+	send := func(topic string, payload string) {
+		s.handleMessage(replayMessage{topic: "N/c0619ab12345/" + topic, payload: []byte(payload)}, time.Now())
+	}
+
+	send("system/0/Serial", `{"value": "c0619ab12345"}`)
+
+	soc := func() float64 {
+		ch := make(chan prometheus.Metric, 100)
+		suffixTopicMap["Soc"].collector.Collect(ch)
+		close(ch)
+
+		for m := range ch {
+			var pb dto.Metric
+			if m.Write(&pb) != nil {
+				continue
+			}
+
+			for _, l := range pb.Label {
+				if l.GetName() == "site" && l.GetValue() == "decode" {
+					return pb.GetGauge().GetValue()
+				}
+			}
+		}
+
+		return 0
+	}
+
+	tests := []struct {
+		payload     string
+		want        float64
+		null        float64
+		unsupported map[string]float64
+		invalid     float64
+	}{
+		{`{"value": 61.5}`, 61.5, 0, nil, 0},
+		{`{"value": null}`, math.NaN(), 1, nil, 0},
+		{`{"value": true}`, 1, 1, nil, 0},
+		{`{"value": "full"}`, 1, 1, map[string]float64{shapeString: 1}, 0},
+		{`{"value": [1, 2]}`, 1, 1, map[string]float64{shapeString: 1, shapeArray: 1}, 0},
+		{`{"value": {"a": 1}}`, 1, 1, map[string]float64{shapeString: 1, shapeArray: 1, shapeObject: 1}, 0},
+		{`not json`, 1, 1, map[string]float64{shapeString: 1, shapeArray: 1, shapeObject: 1}, 1},
+	}
+
+	for _, tt := range tests {
+		send("battery/512/Soc", tt.payload)
+
+		if got := soc(); !sameFloat(got, tt.want) {
+			t.Errorf("after %s: state of charge = %g, want %g", tt.payload, got, tt.want)
+		}
+
+		if got := testutil.ToFloat64(subscriptionsUpdatesNullTotal.WithLabelValues("decode")); got != tt.null {
+			t.Errorf("after %s: null updates = %g, want %g", tt.payload, got, tt.null)
+		}
+
+		for _, shape := range []string{shapeString, shapeArray, shapeObject} {
+			if got := testutil.ToFloat64(subscriptionsUpdatesUnsupportedTotal.WithLabelValues("decode", shape)); got != tt.unsupported[shape] {
+				t.Errorf("after %s: unsupported %s updates = %g, want %g", tt.payload, shape, got, tt.unsupported[shape])
+			}
+		}
+
+		if got := testutil.ToFloat64(subscriptionsUpdatesIgnoredTotal.WithLabelValues("decode", ignoreReasonInvalidJSON)); got != tt.invalid {
+			t.Errorf("after %s: invalid updates = %g, want %g", tt.payload, got, tt.invalid)
+		}
+	}
+
+	send("tank/20/Test/Elements", `{"value": [1.5, "x", [2], {"a": 3}, true]}`)
+	send("tank/20/Test/Elements", `{"value": {"volts": 12.5, "state": null}}`)
+	send("tank/20/Test/Elements", `{"value": 4}`)
+
+	want := map[string]float64{"0": 1.5, "4": 1, "volts": 12.5, "state": math.NaN()}
+
+	got := map[string]float64{}
+	for key := range want {
+		got[key] = testutil.ToFloat64(elements.WithLabelValues("decode", "c0619ab12345", "tank", "20", key))
+	}
+
+	if !sameElements(got, want) || testutil.CollectAndCount(elements) != len(want) {
+		t.Errorf("expanded elements = %v (%d series), want %v", got, testutil.CollectAndCount(elements), want)
+	}
+
+	if got := testutil.ToFloat64(subscriptionsUpdatesUnsupportedTotal.WithLabelValues("decode", shapeNumber)); got != 1 {
+		t.Errorf("unsupported number updates to an expanded path = %g, want 1", got)
+	}
+}
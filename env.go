@@ -3,6 +3,7 @@ package main
 import (
 	"os"
 	"strconv"
+	"strings"
 	"time"
 
 	log "github.com/sirupsen/logrus"
@@ -16,6 +17,24 @@ func getEnv(key string, fallback string) string {
 	return fallback
 }
 
+// getSecretEnv is like getEnv, but reads the value from the file named by
+// key_FILE if that is set, so that secrets can be passed as files.
+func getSecretEnv(key string, fallback string) string {
+	if path, ok := os.LookupEnv(key + "_FILE"); ok {
+		b, err := os.ReadFile(path)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"env_var":   key + "_FILE",
+				"env_value": path}).
+				WithError(err).Fatal("Unable to read file named by ENV VAR")
+		}
+
+		return strings.TrimSpace(string(b))
+	}
+
+	return getEnv(key, fallback)
+}
+
 func getIntEnv(key string, fallback int) int {
 	if value, ok := os.LookupEnv(key); ok {
 		i, err := strconv.Atoi(value)
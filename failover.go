@@ -0,0 +1,203 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	log "github.com/sirupsen/logrus"
+)
+
+// broker is one of the brokers through which a site can be reached.
+type broker struct {
+	name   string
+	config mqttConnectionConfig
+}
+
+// brokerConnection is a site's set of mqtt clients for one broker.
+type brokerConnection struct {
+	site   *site
+	broker int
+	sub    mqtt.Client
+	// pub is the same client as sub when the site uses a single client
+	pub mqtt.Client
+	// unavailableSince is when the connection was first seen to be
+	// down, or the zero time while it is up
+	unavailableSince time.Time
+}
+
+// connectBroker connects to the site's broker at index i, giving up
+// after the connect timeout.
+func (s *site) connectBroker(ctx context.Context, i int) (*brokerConnection, error) {
+	ctx, cancel := context.WithTimeout(ctx, s.opts.connectTimeout)
+	defer cancel()
+
+	b := s.brokers[i]
+	conn := &brokerConnection{site: s, broker: i}
+
+	conn.sub = newSubscriptionClient(s, b.config, s.subClientID, subscriptionTopics(s.opts.subscribeAll, s.opts.writeAPI, s.portal.pinned))
+	conn.pub = conn.sub
+
+	if !s.opts.singleClient {
+		conn.pub = mqtt.NewClient(createClientOptions(s.name, s.pubClientID, b.config, s.opts.connectTimeout, nil))
+	}
+
+	for _, client := range conn.clients() {
+		err := connectWait(ctx, client, s.opts.connectTimeout)
+		if err != nil {
+			conn.disconnect()
+
+			return nil, fmt.Errorf("broker %s: %w", b.name, err)
+		}
+	}
+
+	return conn, nil
+}
+
+// connectPreferred connects to the most preferred of the first n
+// brokers that is available.
+func (s *site) connectPreferred(ctx context.Context, n int) (*brokerConnection, error) {
+	var lastErr error
+
+	for i := 0; i < n; i++ {
+		conn, err := s.connectBroker(ctx, i)
+		if err == nil {
+			return conn, nil
+		}
+
+		s.logger().WithField("broker", s.brokers[i].name).WithError(err).Warn("failed to connect to broker")
+		lastErr = err
+	}
+
+	return nil, lastErr
+}
+
+// switchConnection makes conn the site's active connection and closes
+// the previous one.
+func (s *site) switchConnection(conn *brokerConnection) {
+	s.mu.Lock()
+	previous := s.conn
+	s.conn = conn
+	s.mu.Unlock()
+
+	if previous != nil {
+		brokerFailoversTotal.WithLabelValues(s.name).Inc()
+		s.logger().WithFields(log.Fields{
+			"broker":          s.brokers[conn.broker].name,
+			"previous_broker": s.brokers[previous.broker].name,
+		}).Warn("switched mqtt broker")
+
+		previous.disconnect()
+
+		// Both connections share client IDs, so restore the state that
+		// disconnecting the previous connection cleared
+		for _, clientID := range s.clientIDs() {
+			connections.set(s.name, clientID, true)
+		}
+	}
+
+	for i, b := range s.brokers {
+		active := 0.0
+		if i == conn.broker {
+			active = 1
+		}
+
+		activeBroker.WithLabelValues(s.name, b.name).Set(active)
+	}
+
+	s.watchdog.reset()
+}
+
+// checkBrokerHealth fails over to another broker if the active one has
+// been unavailable for the failover timeout, and periodically tries to
+// return to a more preferred broker.
+func (s *site) checkBrokerHealth(ctx context.Context, now time.Time) {
+	if len(s.brokers) < 2 {
+		return
+	}
+
+	conn := s.connection()
+
+	if conn.available() {
+		conn.unavailableSince = time.Time{}
+	} else if conn.unavailableSince.IsZero() {
+		conn.unavailableSince = now
+	}
+
+	if !conn.unavailableSince.IsZero() && now.Sub(conn.unavailableSince) >= s.opts.failoverTimeout {
+		s.failover(ctx, "broker unavailable")
+
+		return
+	}
+
+	if conn.broker > 0 && s.opts.failbackInterval > 0 && now.Sub(s.lastFailback) >= s.opts.failbackInterval {
+		s.lastFailback = now
+
+		preferred, err := s.connectPreferred(ctx, conn.broker)
+		if err == nil {
+			s.switchConnection(preferred)
+		}
+	}
+}
+
+// failover switches to the most preferred broker other than the active
+// one that can be connected to.
+func (s *site) failover(ctx context.Context, reason string) {
+	current := s.connection()
+	s.logger().WithFields(log.Fields{
+		"broker": s.brokers[current.broker].name,
+		"reason": reason,
+	}).Warn("failing over to another mqtt broker")
+
+	for i, b := range s.brokers {
+		if i == current.broker {
+			continue
+		}
+
+		conn, err := s.connectBroker(ctx, i)
+		if err != nil {
+			s.logger().WithField("broker", b.name).WithError(err).Warn("failed to connect to broker")
+
+			continue
+		}
+
+		s.lastFailback = time.Now()
+		s.switchConnection(conn)
+
+		return
+	}
+
+	s.logger().Error("no other mqtt broker is available")
+}
+
+func (c *brokerConnection) clients() []mqtt.Client {
+	if c.sub == c.pub {
+		return []mqtt.Client{c.sub}
+	}
+
+	return []mqtt.Client{c.sub, c.pub}
+}
+
+func (c *brokerConnection) available() bool {
+	for _, client := range c.clients() {
+		if !client.IsConnectionOpen() {
+			return false
+		}
+	}
+
+	return true
+}
+
+// disconnect closes the connection's clients, waiting briefly for
+// in-flight work to complete. Clients that are still connecting or
+// reconnecting are stopped too.
+func (c *brokerConnection) disconnect() {
+	for _, client := range c.clients() {
+		client.Disconnect(250)
+	}
+
+	for _, clientID := range c.site.clientIDs() {
+		connections.set(c.site.name, clientID, false)
+	}
+}
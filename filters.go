@@ -0,0 +1,325 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	dto "github.com/prometheus/client_model/go"
+	log "github.com/sirupsen/logrus"
+)
+
+// filterRule matches series by regular expressions on their metric name,
+// component type, component ID and path. Every field that is set must
+// match, and each regular expression must match the whole value.
+type filterRule struct {
+	// Metric matches the metric name without the victron_ prefix. Metrics
+	// that are renamed match by either name.
+	Metric        string `yaml:"metric"`
+	ComponentType string `yaml:"component_type"`
+	ComponentID   string `yaml:"component_id"`
+	Path          string `yaml:"path"`
+}
+
+// filtersConfig limits the series exported for paths. When Include is set
+// only the series matching one of its rules are kept, and the series
+// matching any rule in Exclude are dropped.
+type filtersConfig struct {
+	Include []filterRule `yaml:"include"`
+	Exclude []filterRule `yaml:"exclude"`
+}
+
+type compiledFilterRule struct {
+	metric        *regexp.Regexp
+	componentType *regexp.Regexp
+	componentID   *regexp.Regexp
+	path          *regexp.Regexp
+}
+
+// seriesFilter decides which series to export. Decisions are cached, as
+// each one is made for every message received.
+type seriesFilter struct {
+	include []compiledFilterRule
+	exclude []compiledFilterRule
+
+	mu    sync.Mutex
+	cache map[string]bool
+}
+
+// filters is the filter applied by the subscription handler. It keeps
+// every series until applyFilters is called.
+var filters = &seriesFilter{cache: map[string]bool{}}
+
+// filteredPaths are the mapped paths removed by applyFilters, so that
+// they aren't reported as unmapped.
+var filteredPaths = map[string]bool{}
+
+func newSeriesFilter(c filtersConfig) (*seriesFilter, error) {
+	f := &seriesFilter{cache: map[string]bool{}}
+
+	for i, r := range c.Include {
+		rule, err := compileFilterRule(r)
+		if err != nil {
+			return nil, fmt.Errorf("include rule %d: %w", i+1, err)
+		}
+
+		f.include = append(f.include, rule)
+	}
+
+	for i, r := range c.Exclude {
+		rule, err := compileFilterRule(r)
+		if err != nil {
+			return nil, fmt.Errorf("exclude rule %d: %w", i+1, err)
+		}
+
+		f.exclude = append(f.exclude, rule)
+	}
+
+	return f, nil
+}
+
+func compileFilterRule(r filterRule) (compiledFilterRule, error) {
+	if r.Metric == "" && r.ComponentType == "" && r.ComponentID == "" && r.Path == "" {
+		return compiledFilterRule{}, errors.New("rule matches nothing, set at least one of metric, component_type, component_id or path")
+	}
+
+	var (
+		rule compiledFilterRule
+		err  error
+	)
+
+	for _, field := range []struct {
+		name string
+		expr string
+		re   **regexp.Regexp
+	}{
+		{"metric", r.Metric, &rule.metric},
+		{"component_type", r.ComponentType, &rule.componentType},
+		{"component_id", r.ComponentID, &rule.componentID},
+		{"path", r.Path, &rule.path},
+	} {
+		if field.expr == "" {
+			continue
+		}
+
+		*field.re, err = compileAnchored(field.expr)
+		if err != nil {
+			return compiledFilterRule{}, fmt.Errorf("%s: %w", field.name, err)
+		}
+	}
+
+	return rule, nil
+}
+
+// compileAnchored compiles a regular expression that must match the whole
+// of a value, as in Prometheus relabelling.
+func compileAnchored(expr string) (*regexp.Regexp, error) {
+	return regexp.Compile("^(?:" + expr + ")$")
+}
+
+func matchesAny(re *regexp.Regexp, values ...string) bool {
+	if re == nil {
+		return true
+	}
+
+	for _, v := range values {
+		if re.MatchString(v) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// metricNames returns the names a metric is exported under, without the
+// victron_ prefix.
+func metricNames(name string) []string {
+	if r, ok := metricRenames[name]; ok {
+		return []string{name, r.name}
+	}
+
+	return []string{name}
+}
+
+func (r compiledFilterRule) matches(name string, componentType string, componentID string, path string) bool {
+	return matchesAny(r.metric, metricNames(name)...) &&
+		matchesAny(r.componentType, componentType) &&
+		matchesAny(r.componentID, componentID) &&
+		matchesAny(r.path, path)
+}
+
+// mayMatch reports whether the rule matches any series of the metric for
+// path, whatever their component type and ID.
+func (r compiledFilterRule) mayMatch(name string, path string) bool {
+	return matchesAny(r.metric, metricNames(name)...) && matchesAny(r.path, path)
+}
+
+// matchesAll reports whether the rule matches every series of the metric
+// for path.
+func (r compiledFilterRule) matchesAll(name string, path string) bool {
+	return r.componentType == nil && r.componentID == nil && r.mayMatch(name, path)
+}
+
+// keep reports whether a series is exported.
+func (f *seriesFilter) keep(name string, componentType string, componentID string, path string) bool {
+	if len(f.include) == 0 && len(f.exclude) == 0 {
+		return true
+	}
+
+	key := strings.Join([]string{name, componentType, componentID, path}, "\x00")
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if keep, ok := f.cache[key]; ok {
+		return keep
+	}
+
+	keep := len(f.include) == 0
+
+	for _, r := range f.include {
+		if r.matches(name, componentType, componentID, path) {
+			keep = true
+
+			break
+		}
+	}
+
+	for _, r := range f.exclude {
+		if r.matches(name, componentType, componentID, path) {
+			keep = false
+
+			break
+		}
+	}
+
+	f.cache[key] = keep
+
+	return keep
+}
+
+// keepPath reports whether any series of the metric for path may be
+// exported. Paths for which none can be aren't subscribed to.
+func (f *seriesFilter) keepPath(name string, path string) bool {
+	for _, r := range f.exclude {
+		if r.matchesAll(name, path) {
+			return false
+		}
+	}
+
+	if len(f.include) == 0 {
+		return true
+	}
+
+	for _, r := range f.include {
+		if r.mayMatch(name, path) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// applyFilters sets the filter used by the subscription handler, and
+// removes the paths that it excludes entirely, along with their metrics.
+// It must be called before any site starts receiving messages.
+func applyFilters(c filtersConfig) error {
+	f, err := newSeriesFilter(c)
+	if err != nil {
+		return err
+	}
+
+	removed := 0
+
+	for path, o := range suffixTopicMap {
+		if !f.keepPath(o.name, path) {
+			prometheus.Unregister(o.collector)
+			delete(suffixTopicMap, path)
+			filteredPaths[path] = true
+			removed++
+		}
+	}
+
+	for path, e := range elementTopicMap {
+		if !f.keepPath(e.name, path) {
+			prometheus.Unregister(e.collector)
+			delete(elementTopicMap, path)
+			filteredPaths[path] = true
+			removed++
+		}
+	}
+
+	if removed > 0 {
+		log.WithField("paths", removed).Info("filters exclude paths")
+	}
+
+	filters = f
+
+	return nil
+}
+
+// collectGatherer only gathers the metric families whose names match one
+// of the collect[] query parameters.
+type collectGatherer struct {
+	gatherer prometheus.Gatherer
+	collect  []*regexp.Regexp
+}
+
+func newCollectGatherer(g prometheus.Gatherer, collect []string) (collectGatherer, error) {
+	cg := collectGatherer{gatherer: g}
+
+	for _, expr := range collect {
+		re, err := compileAnchored(expr)
+		if err != nil {
+			return cg, fmt.Errorf("collect[] %q: %w", expr, err)
+		}
+
+		cg.collect = append(cg.collect, re)
+	}
+
+	return cg, nil
+}
+
+func (g collectGatherer) Gather() ([]*dto.MetricFamily, error) {
+	mfs, err := g.gatherer.Gather()
+
+	out := mfs[:0]
+
+	for _, mf := range mfs {
+		name := mf.GetName()
+
+		for _, re := range g.collect {
+			// Names match with or without the victron_ prefix
+			if re.MatchString(name) || re.MatchString(strings.TrimPrefix(name, namespace+"_")) {
+				out = append(out, mf)
+
+				break
+			}
+		}
+	}
+
+	return out, err
+}
+
+// serveCollected serves the metrics gathered from g, limited to those
+// selected by the collect[] query parameters, if any.
+func serveCollected(g prometheus.Gatherer, w http.ResponseWriter, r *http.Request) {
+	collect := r.URL.Query()["collect[]"]
+	if len(collect) > 0 {
+		cg, err := newCollectGatherer(g, collect)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+
+			return
+		}
+
+		g = cg
+	}
+
+	promhttp.HandlerFor(g, promhttp.HandlerOpts{}).ServeHTTP(w, r)
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestSeriesFilterKeep(t *testing.T) {
+	tests := []struct {
+		name          string
+		filters       filtersConfig
+		metric        string
+		componentType string
+		componentID   string
+		path          string
+		want          bool
+	}{
+		{"no rules", filtersConfig{}, "led_mains", "vebus", "276", "Leds/Mains", true},
+		// Expressions match the whole name, as in Prometheus relabelling
+		{"anchored", filtersConfig{Include: []filterRule{{Metric: "led"}}}, "led_mains", "vebus", "276", "Leds/Mains", false},
+		{"anchored prefix", filtersConfig{Include: []filterRule{{Metric: "led_.*"}}}, "led_mains", "vebus", "276", "Leds/Mains", true},
+		{"anchored path", filtersConfig{Exclude: []filterRule{{Path: "Leds"}}}, "led_mains", "vebus", "276", "Leds/Mains", true},
+		{"not included", filtersConfig{Include: []filterRule{{ComponentType: "battery"}}}, "led_mains", "vebus", "276", "Leds/Mains", false},
+		{"included", filtersConfig{Include: []filterRule{{ComponentType: "battery"}}}, "dc_voltage_volts", "battery", "512", "Dc/0/Voltage", true},
+		// Exclude rules win over include rules
+		{
+			"excluded after include",
+			filtersConfig{Include: []filterRule{{ComponentType: "battery"}}, Exclude: []filterRule{{Metric: "state_of_charge"}}},
+			"state_of_charge", "battery", "512", "Soc", false,
+		},
+		{
+			"included, not excluded",
+			filtersConfig{Include: []filterRule{{ComponentType: "battery"}}, Exclude: []filterRule{{Metric: "state_of_charge"}}},
+			"dc_voltage_volts", "battery", "512", "Dc/0/Voltage", true,
+		},
+		// Renamed metrics match by either name
+		{"legacy name", filtersConfig{Exclude: []filterRule{{Metric: "state_of_charge"}}}, "state_of_charge", "battery", "512", "Soc", false},
+		{"new name", filtersConfig{Exclude: []filterRule{{Metric: "state_of_charge_ratio"}}}, "state_of_charge", "battery", "512", "Soc", false},
+		{"every field", filtersConfig{Exclude: []filterRule{{ComponentType: "battery", ComponentID: "512"}}}, "state_of_charge", "battery", "513", "Soc", true},
+	}
+
+	for _, tt := range tests {
+		f, err := newSeriesFilter(tt.filters)
+		if err != nil {
+			t.Fatalf("%s: newSeriesFilter() error = %v", tt.name, err)
+		}
+
+		// The second call is answered from the cache
+		for i := 0; i < 2; i++ {
+			if got := f.keep(tt.metric, tt.componentType, tt.componentID, tt.path); got != tt.want {
+				t.Errorf("%s: keep(%s, %s, %s, %s) = %t, want %t", tt.name, tt.metric, tt.componentType, tt.componentID, tt.path, got, tt.want)
+			}
+		}
+	}
+}
+
+func TestFiltersRejectedAtLoad(t *testing.T) {
+	for _, filters := range []string{
+		"include:\n    - metric: '(led'",
+		"exclude:\n    - path: '[Soc'",
+		"exclude:\n    - {}",
+	} {
+		_, err := loadTestConfig(t, "sites:\n  - name: boat\n    host: 192.168.1.20\nfilters:\n  "+filters+"\n", siteConfig{})
+		if err == nil || !strings.Contains(err.Error(), "filters") {
+			t.Errorf("loadConfig() with filters %q error = %v, want a filters error", filters, err)
+		}
+	}
+}
+
+// TestApplyFiltersSubscriptionTopics checks that paths excluded for every
+// component aren't subscribed to.
+func TestApplyFiltersSubscriptionTopics(t *testing.T) {
+	saved := map[string]mqttObserver{}
+	for path, o := range suffixTopicMap {
+		saved[path] = o
+	}
+
+	defer func() {
+		for path, o := range saved {
+			if _, ok := suffixTopicMap[path]; !ok {
+				suffixTopicMap[path] = o
+				prometheus.MustRegister(o.collector)
+			}
+
+			delete(filteredPaths, path)
+		}
+
+		filters = &seriesFilter{cache: map[string]bool{}}
+	}()
+
+	err := applyFilters(filtersConfig{Exclude: []filterRule{
+		{Path: "Leds/.*"},
+		// Only excluded for some components, so still subscribed to
+		{Path: "Soc", ComponentType: "vebus"},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	topics := subscriptionTopics(false, false, "")
+
+	for path, want := range map[string]bool{"Leds/Mains": false, "Leds/Absorption": false, "Soc": true, "Dc/0/Voltage": true} {
+		if _, got := topics["N/+/+/+/"+path]; got != want {
+			t.Errorf("subscribed to %s = %t, want %t", path, got, want)
+		}
+
+		if filteredPaths[path] == want {
+			t.Errorf("%s filtered = %t, want %t", path, filteredPaths[path], !want)
+		}
+	}
+}
+
+func TestServeCollected(t *testing.T) {
+	reg := prometheus.NewRegistry()
+
+	for _, name := range []string{"dc_voltage_volts", "dc_current_amperes", "led_mains"} {
+		g := prometheus.NewGauge(prometheus.GaugeOpts{Namespace: namespace, Name: name, Help: name})
+		reg.MustRegister(g)
+	}
+
+	tests := []struct {
+		query  string
+		status int
+		want   []string
+	}{
+		{"", http.StatusOK, []string{"victron_dc_current_amperes", "victron_dc_voltage_volts", "victron_led_mains"}},
+		{"?collect[]=dc_voltage_volts", http.StatusOK, []string{"victron_dc_voltage_volts"}},
+		{"?collect[]=victron_led_mains", http.StatusOK, []string{"victron_led_mains"}},
+		{"?collect[]=dc_.*&collect[]=led_mains", http.StatusOK, []string{"victron_dc_current_amperes", "victron_dc_voltage_volts", "victron_led_mains"}},
+		// Anchored like filters
+		{"?collect[]=led", http.StatusOK, nil},
+		{"?collect[]=(led", http.StatusBadRequest, nil},
+	}
+
+	for _, tt := range tests {
+		rec := httptest.NewRecorder()
+		serveCollected(reg, rec, httptest.NewRequest("GET", "/metrics"+tt.query, nil))
+
+		if rec.Code != tt.status {
+			t.Errorf("GET /metrics%s = %d, want %d", tt.query, rec.Code, tt.status)
+
+			continue
+		}
+
+		if tt.status != http.StatusOK {
+			continue
+		}
+
+		var got []string
+
+		for _, line := range strings.Split(rec.Body.String(), "\n") {
+			if strings.HasPrefix(line, "# TYPE ") {
+				got = append(got, strings.Fields(line)[2])
+			}
+		}
+
+		if strings.Join(got, ",") != strings.Join(tt.want, ",") {
+			t.Errorf("GET /metrics%s returned %v, want %v", tt.query, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+type siteReadiness struct {
+	Site   string   `json:"site"`
+	Ready  bool     `json:"ready"`
+	Errors []string `json:"errors,omitempty"`
+}
+
+type readiness struct {
+	Status string          `json:"status"`
+	Sites  []siteReadiness `json:"sites"`
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+
+	err := json.NewEncoder(w).Encode(v)
+	if err != nil {
+		log.WithError(err).Warn("failed to write http response")
+	}
+}
+
+// healthzHandler reports that the process is alive.
+func healthzHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+// newReadyzHandler reports whether every site is connected, has a known
+// portal ID and has received a message within maxDataAge.
+func newReadyzHandler(sites func() []*site, maxDataAge time.Duration) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		sites := sites()
+		result := readiness{Status: "ok", Sites: make([]siteReadiness, 0, len(sites))}
+		now := time.Now()
+
+		for _, s := range sites {
+			sr := s.readiness(now, maxDataAge)
+			if !sr.Ready {
+				result.Status = "unavailable"
+			}
+
+			result.Sites = append(result.Sites, sr)
+		}
+
+		status := http.StatusOK
+		if result.Status != "ok" {
+			status = http.StatusServiceUnavailable
+		}
+
+		writeJSON(w, status, result)
+	}
+}
+
+func (s *site) readiness(now time.Time, maxDataAge time.Duration) siteReadiness {
+	var errs []string
+
+	for _, clientID := range s.clientIDs() {
+		if !connections.connected(s.name, clientID) {
+			errs = append(errs, fmt.Sprintf("mqtt client %s is not connected", clientID))
+		}
+	}
+
+	if s.portal.get() == "" {
+		errs = append(errs, "portal ID has not been discovered")
+	}
+
+	last := s.lastMessageTime()
+	if last.IsZero() {
+		errs = append(errs, "no messages received")
+	} else if age := now.Sub(last); age > maxDataAge {
+		errs = append(errs, fmt.Sprintf("last message received %s ago", age.Round(time.Second)))
+	}
+
+	return siteReadiness{Site: s.name, Ready: len(errs) == 0, Errors: errs}
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// The keepalive protocol is documented at
+// https://github.com/victronenergy/dbus-flashmq#keep-alive
+
+const (
+	keepaliveModeAuto      = "auto"
+	keepaliveModeKeepalive = "keepalive"
+	keepaliveModeLegacy    = "legacy"
+)
+
+type keepaliveProtocol int
+
+const (
+	keepaliveProtocolUnknown keepaliveProtocol = iota
+	keepaliveProtocolLegacy
+	keepaliveProtocolKeepalive
+)
+
+func (p keepaliveProtocol) String() string {
+	switch p {
+	case keepaliveProtocolLegacy:
+		return "legacy"
+	case keepaliveProtocolKeepalive:
+		return "keepalive"
+	default:
+		return "unknown"
+	}
+}
+
+// Number of unanswered keepalive probes after which we assume the GX is
+// running the older dbus-mqtt and fall back to the legacy protocol.
+const keepaliveMaxProbes = 3
+
+const suppressRepublishPayload = `{"keepalive-options": ["suppress-republish"]}`
+
+type keepaliveState struct {
+	mu              sync.Mutex
+	mode            string
+	protocol        keepaliveProtocol
+	probes          int
+	needFullPublish bool
+}
+
+func newKeepaliveState(mode string) (*keepaliveState, error) {
+	k := &keepaliveState{mode: mode, needFullPublish: true}
+
+	switch mode {
+	case keepaliveModeAuto:
+	case keepaliveModeKeepalive:
+		k.protocol = keepaliveProtocolKeepalive
+	case keepaliveModeLegacy:
+		k.protocol = keepaliveProtocolLegacy
+	default:
+		return nil, fmt.Errorf("unknown keepalive mode %q", mode)
+	}
+
+	return k, nil
+}
+
+// nextRequest returns the topic and payload of the next keepalive
+// message to publish for the given portal ID.
+func (k *keepaliveState) nextRequest(portalID string) (string, string) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	if k.protocol == keepaliveProtocolUnknown {
+		k.probes++
+		if k.probes > keepaliveMaxProbes {
+			log.WithField("probes", keepaliveMaxProbes).Warn("no response to keepalive requests, falling back to legacy keepalive protocol")
+			k.protocol = keepaliveProtocolLegacy
+		}
+	}
+
+	switch k.protocol {
+	case keepaliveProtocolLegacy:
+		return fmt.Sprintf("R/%s/system/0/Serial", portalID), ""
+	case keepaliveProtocolKeepalive:
+		if !k.needFullPublish {
+			return fmt.Sprintf("R/%s/keepalive", portalID), suppressRepublishPayload
+		}
+		k.needFullPublish = false
+	case keepaliveProtocolUnknown:
+	}
+
+	return fmt.Sprintf("R/%s/keepalive", portalID), ""
+}
+
+// fullPublishCompleted is called when the GX announces that it has
+// completed a full publish, which only dbus-flashmq does.
+func (k *keepaliveState) fullPublishCompleted() {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	if k.mode == keepaliveModeAuto && k.protocol != keepaliveProtocolKeepalive {
+		log.Info("detected keepalive protocol support, suppressing republish on keepalive")
+		k.protocol = keepaliveProtocolKeepalive
+	}
+
+	k.needFullPublish = false
+}
+
+// requestFullPublish ensures the next keepalive asks the GX to
+// republish all topics, for example after the subscription reconnects.
+func (k *keepaliveState) requestFullPublish() {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	k.needFullPublish = true
+	if k.mode == keepaliveModeAuto && k.protocol == keepaliveProtocolLegacy {
+		// The GX may have been upgraded, so probe again
+		k.protocol = keepaliveProtocolUnknown
+		k.probes = 0
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// TestKeepaliveLockedByFullPublish checks that once the GX announces a
+// completed full publish, the site keeps to the keepalive protocol.
+func TestKeepaliveLockedByFullPublish(t *testing.T) {
+	k, err := newKeepaliveState(keepaliveModeAuto)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	topic, payload := k.nextRequest("c0619ab12345")
+	if topic != "R/c0619ab12345/keepalive" || payload != "" {
+		t.Errorf("first request = %s %q, want a keepalive asking for a full publish", topic, payload)
+	}
+
+	k.fullPublishCompleted()
+
+	for i := 0; i < keepaliveMaxProbes*2; i++ {
+		topic, payload = k.nextRequest("c0619ab12345")
+		if topic != "R/c0619ab12345/keepalive" || payload != suppressRepublishPayload {
+			t.Fatalf("request %d = %s %q, want a keepalive suppressing the republish", i+2, topic, payload)
+		}
+	}
+
+	k.requestFullPublish()
+
+	topic, payload = k.nextRequest("c0619ab12345")
+	if topic != "R/c0619ab12345/keepalive" || payload != "" {
+		t.Errorf("request after a reconnect = %s %q, want a keepalive asking for a full publish", topic, payload)
+	}
+
+	if k.protocol != keepaliveProtocolKeepalive {
+		t.Errorf("protocol = %s, want keepalive", k.protocol)
+	}
+}
+
+// TestKeepaliveFallsBackToLegacy runs a site against a broker that, like
+// dbus-mqtt, only answers reads of the serial number.
+func TestKeepaliveFallsBackToLegacy(t *testing.T) {
+	var (
+		mu       sync.Mutex
+		requests []string
+		server   *mqttServer
+	)
+
+	server = newMQTTServer(func(topic string, payload []byte) {
+		mu.Lock()
+		requests = append(requests, topic)
+		mu.Unlock()
+
+		if topic == "R/c0619ab12345/system/0/Serial" {
+			server.publish("N/c0619ab12345/system/0/Serial", []byte(`{"value": "c0619ab12345"}`), true)
+		}
+	})
+	server.publish("N/c0619ab12345/system/0/Serial", []byte(`{"value": "c0619ab12345"}`), true)
+
+	s := newTestSite(t, "legacy", startTestBroker(t, server))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go func() { _ = s.run(ctx) }()
+
+	legacy := func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+
+		for _, topic := range requests {
+			if topic == "R/c0619ab12345/system/0/Serial" {
+				return true
+			}
+		}
+
+		return false
+	}
+
+	if !waitFor(legacy) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		t.Fatalf("no legacy keepalive after unanswered keepalives, requests: %s", strings.Join(requests, ", "))
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	keepalives := 0
+
+	for _, topic := range requests {
+		if topic == "R/c0619ab12345/system/0/Serial" {
+			break
+		}
+
+		if topic == "R/c0619ab12345/keepalive" {
+			keepalives++
+		}
+	}
+
+	if keepalives != keepaliveMaxProbes {
+		t.Errorf("%d keepalives before falling back, want %d", keepalives, keepaliveMaxProbes)
+	}
+}
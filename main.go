@@ -1,22 +1,53 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
-	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/prometheus/client_golang/prometheus"
 	log "github.com/sirupsen/logrus"
 )
 
-var systemSerialID = ""
+// shutdownTimeout bounds how long the http server is given to finish
+// serving in-flight requests on shutdown.
+const shutdownTimeout = 5 * time.Second
 
 var (
 	listenAddress = flag.String("web.listen-address",
 		getEnv("LISTEN_ADDR", "127.0.0.1:9226"),
 		"Address on which to expose metrics and web interface.")
 
+	configFile = flag.String("config.file",
+		getEnv("CONFIG_FILE", ""),
+		"Path to a YAML configuration file listing the sites to monitor. Flags provide defaults for settings it leaves out")
+
+	configReloadInterval = flag.Duration("config.reload_interval",
+		getDurationEnv("CONFIG_RELOAD_INTERVAL", 30*time.Second),
+		"Interval at which to check the configuration file for changes. 0 disables; SIGHUP always reloads")
+
+	apiToken = flag.String("web.api_token",
+		getSecretEnv("WEB_API_TOKEN", ""),
+		"Bearer token required by the write API. The write API is disabled when empty")
+
+	apiWriteTimeout = flag.Duration("web.api_write_timeout",
+		getDurationEnv("WEB_API_WRITE_TIMEOUT", 10*time.Second),
+		"Time the write API waits for the GX to confirm a write")
+
+	readyMaxDataAge = flag.Duration("web.ready_max_data_age",
+		getDurationEnv("WEB_READY_MAX_DATA_AGE", time.Minute),
+		"Maximum time since the last MQTT message for /readyz to report ready")
+
+	connectTimeout = flag.Duration("mqtt.connect_timeout",
+		getDurationEnv("MQTT_CONNECT_TIMEOUT", 30*time.Second),
+		"Time allowed to connect to each site at startup before exiting")
+
 	clientPrefix = flag.String("mqtt.client_prefix",
 		getEnv("MQTT_CLIENT_PREFIX", "victron_exporter"),
 		"Prefix for MQTT clientID")
@@ -42,62 +73,274 @@ var (
 		"Victron MQTT Cloud Username")
 
 	password = flag.String("mqtt.password",
-		getEnv("MQTT_PASSWORD", ""),
+		getSecretEnv("MQTT_PASSWORD", ""),
 		"Victron MQTT Cloud Password")
 
+	brokerURL = flag.String("mqtt.url",
+		getEnv("MQTT_URL", ""),
+		"Broker URL (tcp://, ssl://, ws:// or wss://), overrides -mqtt.host, -mqtt.port and -mqtt.secure")
+
+	tlsCAFile = flag.String("mqtt.tls.ca_file",
+		getEnv("MQTT_TLS_CA_FILE", ""),
+		"PEM file of CA certificates used to verify the broker. Defaults to the embedded Venus CA")
+
+	tlsSystemRoots = flag.Bool("mqtt.tls.system_roots",
+		getBoolEnv("MQTT_TLS_SYSTEM_ROOTS", false),
+		"Verify the broker using the system root certificates")
+
+	tlsCertFile = flag.String("mqtt.tls.cert_file",
+		getEnv("MQTT_TLS_CERT_FILE", ""),
+		"PEM file of the client certificate to present to the broker")
+
+	tlsKeyFile = flag.String("mqtt.tls.key_file",
+		getEnv("MQTT_TLS_KEY_FILE", ""),
+		"PEM file of the client certificate's private key")
+
+	tlsServerName = flag.String("mqtt.tls.server_name",
+		getEnv("MQTT_TLS_SERVER_NAME", ""),
+		"Override the hostname used to verify the broker certificate")
+
+	tlsInsecureSkipVerify = flag.Bool("mqtt.tls.insecure_skip_verify",
+		getBoolEnv("MQTT_TLS_INSECURE_SKIP_VERIFY", false),
+		"Do not verify the broker certificate")
+
+	vrmPortalID = flag.String("vrm.portal_id",
+		getEnv("VRM_PORTAL_ID", ""),
+		"VRM portal ID. Selects the VRM MQTT broker when -mqtt.host is not set")
+
+	singleClient = flag.Bool("mqtt.single_client",
+		getBoolEnv("MQTT_SINGLE_CLIENT", false),
+		"Use a single MQTT connection per site for both subscribing and publishing keepalives")
+
+	vrmAccessToken = flag.String("vrm.access_token",
+		getSecretEnv("VRM_ACCESS_TOKEN", ""),
+		"VRM personal access token, used to authenticate with VRM MQTT instead of -mqtt.password")
+
+	vrmLoginEnabled = flag.Bool("vrm.login",
+		getBoolEnv("VRM_LOGIN", false),
+		"Obtain VRM MQTT credentials by logging in to the VRM API with -mqtt.username and -mqtt.password")
+
+	vrmAPIURL = flag.String("vrm.api_url",
+		getEnv("VRM_API_URL", defaultVRMAPIURL),
+		"Base URL of the VRM API used by -vrm.login")
+
+	subscribeAll = flag.Bool("mqtt.subscribe_all",
+		getBoolEnv("MQTT_SUBSCRIBE_ALL", false),
+		"Subscribe to every topic on the bus (#) instead of only mapped paths")
+
+	keepaliveMode = flag.String("victron.keepalive_mode",
+		getEnv("VICTRON_KEEPALIVE_MODE", keepaliveModeAuto),
+		"Keepalive protocol: auto, keepalive (Venus OS dbus-flashmq) or legacy (dbus-mqtt)")
+
+	failoverTimeout = flag.Duration("mqtt.failover_timeout",
+		getDurationEnv("MQTT_FAILOVER_TIMEOUT", time.Minute),
+		"Time a site's broker may be unavailable before failing over to its next broker")
+
+	failbackInterval = flag.Duration("mqtt.failback_interval",
+		getDurationEnv("MQTT_FAILBACK_INTERVAL", 5*time.Minute),
+		"Interval at which a site that has failed over retries its preferred brokers")
+
+	watchdogTimeout = flag.Duration("victron.watchdog_timeout",
+		getDurationEnv("VICTRON_WATCHDOG_TIMEOUT", 5*time.Minute),
+		"Force the subscription to reconnect when no messages arrive within this time after a keepalive. 0 disables")
+
+	lastUpdateTimestamps = flag.Bool("victron.last_update_timestamps",
+		getBoolEnv("VICTRON_LAST_UPDATE_TIMESTAMPS", false),
+		"Export the time of the last update received for each mapped path")
+
+	sampleTimestamps = flag.Bool("victron.sample_timestamps",
+		getBoolEnv("VICTRON_SAMPLE_TIMESTAMPS", false),
+		"Expose the samples of mapped paths with the time at which their last update was received, rather than the scrape time")
+
+	metricNaming = flag.String("metrics.naming",
+		getEnv("METRICS_NAMING", namingLegacy),
+		"Metric names to export: legacy, prometheus (following the Prometheus naming conventions) or both while dashboards are migrated")
+
+	recordFile = flag.String("mqtt.record_file",
+		getEnv("MQTT_RECORD_FILE", ""),
+		"Record every received MQTT message to this gzipped JSONL file, for use with the replay command")
+
 	logLevel = flag.Int("log.level",
 		getIntEnv("LOG_LEVEL", 2),
 		"Log level: 0=debug, 1=info, 2=warn, 3=error")
 )
 
 func main() {
+	if len(os.Args) > 1 {
+		if _, ok := commands[os.Args[1]]; ok {
+			os.Exit(runCommand(os.Args[1], os.Args[2:]))
+		}
+	}
+
+	flag.Usage = usage
 	flag.Parse()
 
 	setLogLevel(*logLevel)
 
-	log.WithField("address", *listenAddress).Info("victron_exporter listening")
+	err := validateNaming(*metricNaming)
+	if err != nil {
+		log.WithError(err).Fatal("invalid configuration")
+	}
+
+	if *lastUpdateTimestamps {
+		prometheus.MustRegister(lastUpdateTimestampSeconds)
+	}
 
-	http.Handle("/metrics", promhttp.Handler())
-	go func() {
-		err := http.ListenAndServe(*listenAddress, nil)
+	c, err := loadConfiguration()
+	if err != nil {
+		log.WithError(err).Fatal("invalid configuration")
+	}
+
+	err = registerMappings(c.Mappings)
+	if err != nil {
+		log.WithError(err).Fatal("invalid configuration")
+	}
+
+	err = applyFilters(c.Filters)
+	if err != nil {
+		log.WithError(err).Fatal("invalid configuration")
+	}
+
+	var rec *recorder
+
+	if *recordFile != "" {
+		rec, err = newRecorder(*recordFile)
 		if err != nil {
-			log.WithField("address", *listenAddress).WithError(err).Fatal("failed to listen on address")
+			log.WithError(err).Fatal("invalid configuration")
 		}
-	}()
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	supervisor := newSiteSupervisor(ctx, siteOptions{
+		clientPrefix:     *clientPrefix,
+		keepaliveMode:    *keepaliveMode,
+		pollInterval:     *pollInterval,
+		subscribeAll:     *subscribeAll,
+		connectTimeout:   *connectTimeout,
+		watchdogTimeout:  *watchdogTimeout,
+		failoverTimeout:  *failoverTimeout,
+		failbackInterval: *failbackInterval,
+		singleClient:     *singleClient,
+		writeAPI:         *apiToken != "",
+		recorder:         rec,
+	})
+
+	err = supervisor.apply(c.Sites)
+	if err != nil {
+		log.WithError(err).Fatal("invalid configuration")
+	}
+
+	if *configFile != "" {
+		reloader := &configReloader{
+			path:       *configFile,
+			interval:   *configReloadInterval,
+			load:       loadConfiguration,
+			supervisor: supervisor,
+			initial:    c,
+		}
+		go reloader.run(ctx)
+	}
+
+	log.WithField("address", c.HTTP.ListenAddress).Info("victron_exporter listening")
 
-	mqttOpts := mqttConnectionConfig{*host, *port, *secure, *username, *password}
+	prometheus.MustRegister(newLastMessageAgeCollector(supervisor.sites))
+
+	http.Handle("/metrics", metricsHandler())
+	http.HandleFunc("/healthz", healthzHandler)
+	http.Handle("/debug/unmapped", newUnmappedHandler(*subscribeAll))
+	http.Handle("/readyz", newReadyzHandler(supervisor.sites, c.HTTP.ReadyMaxDataAge))
+
+	if *apiToken != "" {
+		http.Handle(writeAPIPrefix, newWriteAPIHandler(supervisor.sites, *apiToken, *apiWriteTimeout))
+	}
+	server := &http.Server{Addr: c.HTTP.ListenAddress, ReadHeaderTimeout: 10 * time.Second}
 	go func() {
-		err := listen(*clientPrefix+"_sub", mqttOpts, "#")
-		if err != nil {
-			log.WithError(err).Fatal("failed to establish mqtt subscription connection")
+		err := server.ListenAndServe()
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.WithField("address", c.HTTP.ListenAddress).WithError(err).Fatal("failed to listen on address")
 		}
 	}()
 
-	client, err := connect(*clientPrefix+"_pub", mqttOpts)
+	failed := supervisor.wait()
+	stop()
+
+	if rec != nil {
+		err = rec.close()
+		if err != nil {
+			log.WithError(err).Error("failed to close recording")
+		}
+	}
+
+	log.Info("shutting down")
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+
+	err = server.Shutdown(shutdownCtx)
 	if err != nil {
-		log.WithError(err).Fatal("failed to establish mqtt publish connection")
+		log.WithError(err).Warn("failed to shut down http server")
 	}
 
-	timer := time.NewTicker(*pollInterval)
-	for range timer.C {
-		if !client.IsConnectionOpen() {
-			log.Debug("mqtt connection not yet established")
+	if failed {
+		cancel()
+		os.Exit(1)
+	}
+}
 
-			continue
-		}
+// loadConfiguration reads the configuration file, or builds a single site
+// from the command line flags if there isn't one.
+func loadConfiguration() (*config, error) {
+	defaults := siteConfig{
+		Name: defaultSiteName,
+		brokerSettings: brokerSettings{
+			URL:         *brokerURL,
+			Host:        *host,
+			Port:        *port,
+			Secure:      secure,
+			Username:    *username,
+			Password:    *password,
+			AccessToken: *vrmAccessToken,
+			VRMLogin:    vrmLoginEnabled,
+			VRMAPIURL:   *vrmAPIURL,
+			TLS: &tlsSettings{
+				CAFile:             *tlsCAFile,
+				SystemRoots:        *tlsSystemRoots,
+				CertFile:           *tlsCertFile,
+				KeyFile:            *tlsKeyFile,
+				ServerName:         *tlsServerName,
+				InsecureSkipVerify: *tlsInsecureSkipVerify,
+			},
+		},
+	}
 
-		// Check whether we've heard back from victron mqtt yet...
-		if systemSerialID == "" {
-			log.Debug("awaiting system serial ID response from Victron mqtt bus")
+	defaultHTTP := httpConfig{
+		ListenAddress:   *listenAddress,
+		ReadyMaxDataAge: *readyMaxDataAge,
+	}
 
-			continue
-		}
+	if *configFile != "" {
+		return loadConfig(*configFile, defaults, defaultHTTP)
+	}
 
-		token := client.Publish(fmt.Sprintf("R/%s/system/0/Serial", systemSerialID), 1, false, "")
-		for !token.WaitTimeout(5 * time.Second) {
-			if err := token.Error(); err != nil {
-				log.WithError(err).Error("mqtt publish failed")
-			}
-		}
+	flagSite := defaults
+	flagSite.PortalID = *vrmPortalID
+
+	c := &config{HTTP: defaultHTTP, Sites: []siteConfig{flagSite}}
+
+	return c, c.validate()
+}
+
+func usage() {
+	out := flag.CommandLine.Output()
+	fmt.Fprintf(out, "Usage: victron-exporter [flags]\n")
+	fmt.Fprintf(out, "       victron-exporter <command> [flags] [args]\n\nCommands:\n")
+
+	for _, name := range commandNames() {
+		fmt.Fprintf(out, "  %s\n", commands[name].usage)
 	}
+
+	fmt.Fprintf(out, "\nFlags:\n")
+	flag.PrintDefaults()
 }
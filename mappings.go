@@ -0,0 +1,178 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	mappingTypeGauge   = "gauge"
+	mappingTypeCounter = "counter"
+)
+
+// mappingConfig maps a path that isn't built in to a metric, so that new
+// Venus OS paths can be exported without a new release.
+type mappingConfig struct {
+	// Path is the dbus path after the component ID, for example
+	// Dc/Battery/Temperature
+	Path string `yaml:"path"`
+	// Name is the metric name, without the victron_ prefix
+	Name string `yaml:"name"`
+	Help string `yaml:"help"`
+	// Type is gauge (the default) or counter
+	Type   string            `yaml:"type"`
+	Labels map[string]string `yaml:"labels"`
+	// Expand exports each element of an array or object value as its own
+	// series, with this label set to the element's index or key. Only
+	// gauges can be expanded.
+	Expand string `yaml:"expand"`
+	// Transform adjusts values before they are exported. A mapping with a
+	// transform but no name adjusts a built-in path instead of adding a
+	// metric.
+	Transform *transformConfig `yaml:"transform"`
+}
+
+// labelName matches valid Prometheus label names.
+var labelName = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// configuredPaths are the paths added to suffixTopicMap by mappings, so
+// that a reloaded configuration isn't rejected for mapping them again.
+var configuredPaths = map[string]bool{}
+
+func validateMappings(mappings []mappingConfig) error {
+	paths := map[string]bool{}
+
+	for _, m := range mappings {
+		if m.Path == "" {
+			return fmt.Errorf("mapping for metric %q has no path", m.Name)
+		}
+
+		if reservedMetricName(m.Name) {
+			return fmt.Errorf("mapping for path %q: metric name %q is reserved for a built-in metric", m.Path, m.Name)
+		}
+
+		if m.Transform != nil {
+			err := m.Transform.validate()
+			if err != nil {
+				return fmt.Errorf("mapping for path %q: transform: %w", m.Path, err)
+			}
+		}
+
+		if paths[m.Path] {
+			return fmt.Errorf("duplicate mapping for path %q", m.Path)
+		}
+		paths[m.Path] = true
+
+		_, mapped := suffixTopicMap[m.Path]
+		_, expanded := elementTopicMap[m.Path]
+		// Paths removed by filters were mapped when the config was loaded
+		mapped = mapped || filteredPaths[m.Path]
+
+		if m.Name == "" {
+			if m.Transform == nil {
+				return fmt.Errorf("mapping for path %q has no metric name", m.Path)
+			}
+
+			if (!mapped && !expanded) || configuredPaths[m.Path] {
+				return fmt.Errorf("mapping for path %q has no metric name, and the path has no built-in mapping to transform", m.Path)
+			}
+
+			continue
+		}
+
+		switch m.Type {
+		case "", mappingTypeGauge, mappingTypeCounter:
+		default:
+			return fmt.Errorf("mapping for path %q has unknown type %q", m.Path, m.Type)
+		}
+
+		if m.Expand != "" {
+			if m.Type == mappingTypeCounter {
+				return fmt.Errorf("mapping for path %q: only gauges can be expanded", m.Path)
+			}
+
+			// Labels starting with __ are reserved for Prometheus' own use
+			if !labelName.MatchString(m.Expand) || strings.HasPrefix(m.Expand, "__") {
+				return fmt.Errorf("mapping for path %q: expand label %q is not a valid label name", m.Path, m.Expand)
+			}
+
+			for _, l := range labels {
+				if m.Expand == l {
+					return fmt.Errorf("mapping for path %q: expand label %q is already used", m.Path, m.Expand)
+				}
+			}
+
+			if _, ok := m.Labels[m.Expand]; ok {
+				return fmt.Errorf("mapping for path %q: expand label %q is already used", m.Path, m.Expand)
+			}
+		}
+
+		if (mapped || expanded) && !configuredPaths[m.Path] {
+			return fmt.Errorf("path %q is already mapped", m.Path)
+		}
+	}
+
+	return nil
+}
+
+// registerMappings adds the configured mappings to suffixTopicMap, and
+// their transforms to transformTopicMap. It must be called before any
+// site starts receiving messages.
+func registerMappings(mappings []mappingConfig) error {
+	for _, m := range mappings {
+		if m.Transform != nil {
+			transformTopicMap[m.Path] = m.Transform
+		}
+
+		if m.Name == "" {
+			continue
+		}
+
+		if m.Expand != "" {
+			o, err := newElementGaugeObserver(prometheus.GaugeOpts{
+				Name:        m.Name,
+				Help:        m.Help,
+				ConstLabels: m.Labels,
+			}, m.Expand)
+			if err != nil {
+				return fmt.Errorf("mapping for path %q: %w", m.Path, err)
+			}
+
+			elementTopicMap[m.Path] = o
+			configuredPaths[m.Path] = true
+
+			continue
+		}
+
+		var (
+			o   mqttObserver
+			err error
+		)
+
+		if m.Type == mappingTypeCounter {
+			o, err = newCounterObserver(prometheus.CounterOpts{
+				Name:        m.Name,
+				Help:        m.Help,
+				ConstLabels: m.Labels,
+			})
+		} else {
+			o, err = newGaugeObserver(prometheus.GaugeOpts{
+				Name:        m.Name,
+				Help:        m.Help,
+				ConstLabels: m.Labels,
+			})
+		}
+
+		if err != nil {
+			return fmt.Errorf("mapping for path %q: %w", m.Path, err)
+		}
+
+		suffixTopicMap[m.Path] = o
+		configuredPaths[m.Path] = true
+	}
+
+	return nil
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidateMappingsExpand(t *testing.T) {
+	tests := []struct {
+		expand string
+		labels map[string]string
+		err    string
+	}{
+		{"key", nil, ""},
+		{"phase_n", nil, ""},
+		{"site", nil, "already used"},
+		{"portal_id", nil, "already used"},
+		{"component_type", nil, "already used"},
+		{"component_id", nil, "already used"},
+		{"unit", map[string]string{"unit": "a"}, "already used"},
+		{"element-key", nil, "not a valid label name"},
+		{"0key", nil, "not a valid label name"},
+		{"__name__", nil, "not a valid label name"},
+	}
+
+	for _, tt := range tests {
+		err := validateMappings([]mappingConfig{{
+			Path:   "Test/Expanded",
+			Name:   "test_expanded",
+			Expand: tt.expand,
+			Labels: tt.labels,
+		}})
+
+		switch {
+		case tt.err == "" && err != nil:
+			t.Errorf("expand %q: validateMappings() error = %v", tt.expand, err)
+		case tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)):
+			t.Errorf("expand %q: validateMappings() error = %v, want %q", tt.expand, err, tt.err)
+		}
+	}
+}
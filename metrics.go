@@ -1,7 +1,12 @@
 package main
 
 import (
+	"strings"
+	"sync"
+	"time"
+
 	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
 )
 
 const namespace = "victron"
@@ -11,30 +16,319 @@ var (
 		Namespace: namespace,
 		Name:      "mqtt_connection_state",
 		Help:      "0=Disconnected; 1=Connected",
-	}, []string{"client_id"})
+	}, []string{"site", "client_id"})
 
 	connectionStatusSinceTimeSeconds = prometheus.NewGaugeVec(prometheus.GaugeOpts{
 		Namespace: namespace,
 		Name:      "mqtt_connection_state_since_time_seconds",
 		Help:      "Time since last change to mqtt_connection_state",
-	}, []string{"client_id"})
+	}, []string{"site", "client_id"})
 
-	subscriptionsUpdatesTotal = prometheus.NewCounter(prometheus.CounterOpts{
+	subscriptionsUpdatesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
 		Namespace: namespace,
 		Name:      "mqtt_subscription_updates_total",
 		Help:      "MQTT subscriptions updated received",
-	})
+	}, []string{"site"})
 
-	subscriptionsUpdatesIgnoredTotal = prometheus.NewCounter(prometheus.CounterOpts{
+	subscriptionsUpdatesIgnoredTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
 		Namespace: namespace,
 		Name:      "mqtt_subscription_updates_ignored_total",
-		Help:      "MQTT subscription updates ignored",
-	})
+		Help:      "MQTT subscription updates ignored, by reason: short_topic, not_notification, other_portal, unmapped, filtered or invalid_json",
+	}, []string{"site", "reason"})
+
+	subscriptionsUpdatesNullTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "mqtt_subscription_updates_null_total",
+		Help:      "MQTT subscription updates for mapped paths with a null value, exported as NaN",
+	}, []string{"site"})
+
+	subscriptionsUpdatesUnsupportedTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "mqtt_subscription_updates_unsupported_total",
+		Help:      "MQTT subscription updates for mapped paths whose value has a shape the mapping can't export, by shape",
+	}, []string{"site", "shape"})
+
+	messagesReceivedTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "mqtt_messages_received_total",
+		Help:      "MQTT messages received for each service (component type)",
+	}, []string{"site", "component_type"})
+
+	messagePayloadBytes = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "mqtt_message_payload_bytes",
+		Help:      "Size of received MQTT message payloads",
+		Buckets:   prometheus.ExponentialBuckets(16, 2, 9),
+	}, []string{"site"})
+
+	messageHandlerDurationSeconds = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "mqtt_message_handler_duration_seconds",
+		Help:      "Time taken to handle a received MQTT message",
+		Buckets:   prometheus.ExponentialBuckets(1e-6, 4, 10),
+	}, []string{"site"})
+
+	keepalivePublishesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "keepalive_publishes_total",
+		Help:      "Keepalive requests published, by result: success or failure",
+	}, []string{"site", "result"})
+
+	subscriptionsUpdatesMappedTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "mqtt_subscription_updates_mapped_total",
+		Help:      "MQTT subscription updates that were mapped to a metric",
+	}, []string{"site"})
+
+	watchdogReconnectsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "mqtt_watchdog_reconnects_total",
+		Help:      "Subscription reconnects forced because no messages arrived after a keepalive",
+	}, []string{"site"})
+
+	activeBroker = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "mqtt_active_broker",
+		Help:      "1 for the broker a site is currently connected through, 0 for its other brokers",
+	}, []string{"site", "broker"})
+
+	brokerFailoversTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "mqtt_broker_failovers_total",
+		Help:      "Number of times a site has switched broker",
+	}, []string{"site"})
+
+	lastUpdateTimestampSeconds = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "last_update_timestamp_seconds",
+		Help:      "Time at which the last update for a mapped path was received",
+	}, []string{"site", "portal_id", "component_type", "component_id", "path"})
+
+	portalInfo = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "portal_info",
+		Help:      "Portal ID of the GX device that a site is connected to",
+	}, []string{"site", "portal_id"})
+)
+
+// siteMetrics are the metric vectors with a site label, so that a site's
+// series can be removed when the site is removed from the configuration.
+var (
+	siteMetricsMu sync.Mutex
+	siteMetrics   []*prometheus.MetricVec
 )
 
+func registerSiteMetric(c prometheus.Collector, vec *prometheus.MetricVec) error {
+	err := prometheus.Register(c)
+	if err != nil {
+		return err
+	}
+
+	siteMetricsMu.Lock()
+	siteMetrics = append(siteMetrics, vec)
+	siteMetricsMu.Unlock()
+
+	return nil
+}
+
+func deleteSiteMetrics(site string) {
+	siteMetricsMu.Lock()
+	defer siteMetricsMu.Unlock()
+
+	for _, vec := range siteMetrics {
+		vec.DeletePartialMatch(prometheus.Labels{"site": site})
+	}
+
+	for _, vec := range timestampedVecs {
+		vec.deletePrefix(site)
+	}
+}
+
+// deletePortalMetrics removes a site's series for a portal it no longer
+// talks to.
+func deletePortalMetrics(site string, portalID string) {
+	siteMetricsMu.Lock()
+	defer siteMetricsMu.Unlock()
+
+	// Vectors without a portal_id label are left alone
+	for _, vec := range siteMetrics {
+		vec.DeletePartialMatch(prometheus.Labels{"site": site, "portal_id": portalID})
+	}
+
+	for _, vec := range timestampedVecs {
+		if len(vec.labels) > 1 && vec.labels[1] == "portal_id" {
+			vec.deletePrefix(site, portalID)
+		}
+	}
+}
+
+// timestampedVecs are the metric vectors of mapped paths.
+var timestampedVecs []*timestampedVec
+
+// timestampedVec wraps the metric vector of a mapped path, recording when
+// each of its series was last updated. With -victron.sample_timestamps
+// the samples are exposed with that time rather than the scrape time.
+type timestampedVec struct {
+	prometheus.Collector
+	// labels are the variable labels of the vector, starting with site
+	labels []string
+
+	mu    sync.Mutex
+	times map[string]time.Time
+}
+
+func newTimestampedVec(c prometheus.Collector, labels []string) *timestampedVec {
+	v := &timestampedVec{Collector: c, labels: labels, times: map[string]time.Time{}}
+
+	siteMetricsMu.Lock()
+	timestampedVecs = append(timestampedVecs, v)
+	siteMetricsMu.Unlock()
+
+	return v
+}
+
+// updated records that the series with labelValues was updated at t.
+func (v *timestampedVec) updated(t time.Time, labelValues ...string) {
+	if !*sampleTimestamps {
+		return
+	}
+
+	v.mu.Lock()
+	v.times[strings.Join(labelValues, "\x00")] = t
+	v.mu.Unlock()
+}
+
+// deletePrefix forgets the update times of the series whose first label
+// values are values.
+func (v *timestampedVec) deletePrefix(values ...string) {
+	prefix := strings.Join(values, "\x00") + "\x00"
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	for key := range v.times {
+		if strings.HasPrefix(key, prefix) {
+			delete(v.times, key)
+		}
+	}
+}
+
+func (v *timestampedVec) Collect(ch chan<- prometheus.Metric) {
+	if !*sampleTimestamps {
+		v.Collector.Collect(ch)
+
+		return
+	}
+
+	metrics := make(chan prometheus.Metric)
+
+	go func() {
+		v.Collector.Collect(metrics)
+		close(metrics)
+	}()
+
+	for m := range metrics {
+		if t, ok := v.updateTime(m); ok {
+			m = prometheus.NewMetricWithTimestamp(t, m)
+		}
+
+		ch <- m
+	}
+}
+
+// updateTime returns when the series of m was last updated.
+func (v *timestampedVec) updateTime(m prometheus.Metric) (time.Time, bool) {
+	var pb dto.Metric
+
+	if m.Write(&pb) != nil {
+		return time.Time{}, false
+	}
+
+	values := map[string]string{}
+	for _, l := range pb.Label {
+		values[l.GetName()] = l.GetValue()
+	}
+
+	key := make([]string, len(v.labels))
+	for i, name := range v.labels {
+		key[i] = values[name]
+	}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	t, ok := v.times[strings.Join(key, "\x00")]
+
+	return t, ok
+}
+
 func init() {
 	prometheus.MustRegister(connectionStatus)
 	prometheus.MustRegister(connectionStatusSinceTimeSeconds)
 	prometheus.MustRegister(subscriptionsUpdatesTotal)
 	prometheus.MustRegister(subscriptionsUpdatesIgnoredTotal)
+	prometheus.MustRegister(subscriptionsUpdatesMappedTotal)
+	prometheus.MustRegister(watchdogReconnectsTotal)
+	prometheus.MustRegister(activeBroker)
+	prometheus.MustRegister(brokerFailoversTotal)
+	prometheus.MustRegister(portalInfo)
+	prometheus.MustRegister(subscriptionsUpdatesNullTotal)
+	prometheus.MustRegister(subscriptionsUpdatesUnsupportedTotal)
+	prometheus.MustRegister(messagesReceivedTotal)
+	prometheus.MustRegister(messagePayloadBytes)
+	prometheus.MustRegister(messageHandlerDurationSeconds)
+	prometheus.MustRegister(keepalivePublishesTotal)
+
+	siteMetrics = append(siteMetrics,
+		connectionStatus.MetricVec,
+		connectionStatusSinceTimeSeconds.MetricVec,
+		subscriptionsUpdatesTotal.MetricVec,
+		subscriptionsUpdatesIgnoredTotal.MetricVec,
+		subscriptionsUpdatesMappedTotal.MetricVec,
+		watchdogReconnectsTotal.MetricVec,
+		activeBroker.MetricVec,
+		brokerFailoversTotal.MetricVec,
+		lastUpdateTimestampSeconds.MetricVec,
+		portalInfo.MetricVec,
+		subscriptionsUpdatesNullTotal.MetricVec,
+		subscriptionsUpdatesUnsupportedTotal.MetricVec,
+		messagesReceivedTotal.MetricVec,
+		messagePayloadBytes.MetricVec,
+		messageHandlerDurationSeconds.MetricVec,
+		keepalivePublishesTotal.MetricVec,
+	)
+}
+
+// lastMessageAgeCollector exports the time since each site last received
+// a message, computed when scraped.
+type lastMessageAgeCollector struct {
+	sites func() []*site
+	desc  *prometheus.Desc
+}
+
+func newLastMessageAgeCollector(sites func() []*site) *lastMessageAgeCollector {
+	return &lastMessageAgeCollector{
+		sites: sites,
+		desc: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "mqtt", "last_message_age_seconds"),
+			"Time since the last MQTT message was received for a site",
+			[]string{"site"}, nil),
+	}
+}
+
+func (c *lastMessageAgeCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.desc
+}
+
+func (c *lastMessageAgeCollector) Collect(ch chan<- prometheus.Metric) {
+	now := time.Now()
+
+	for _, s := range c.sites() {
+		last := s.lastMessageTime()
+		if last.IsZero() {
+			continue
+		}
+
+		ch <- prometheus.MustNewConstMetric(c.desc, prometheus.GaugeValue, now.Sub(last).Seconds(), s.name)
+	}
 }
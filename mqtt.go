@@ -1,11 +1,11 @@
 package main
 
 import (
+	"context"
 	"crypto/tls"
-	"crypto/x509"
-	"encoding/json"
 	"fmt"
-	"math"
+	"net/http"
+	"net/url"
 	"strings"
 	"time"
 
@@ -13,45 +13,79 @@ import (
 	log "github.com/sirupsen/logrus"
 )
 
-func newTLSConfig() *tls.Config {
-	// First, create the set of root certificates. For this example we only
-	// have one. It's also possible to omit this in order to use the
-	// default root set of the current operating system.
-	roots := x509.NewCertPool()
-	ok := roots.AppendCertsFromPEM([]byte(rootPEM))
-	if !ok {
-		panic("failed to parse root certificate")
-	}
-
-	// Create tls.Config with desired tls properties
-	return &tls.Config{
-		// RootCAs = certs used to verify server cert.
-		RootCAs: roots,
-		// ClientAuth = whether to request cert from server.
-		// Since the server is set up for SSL, this happens
-		// anyways.
-		ClientAuth: tls.NoClientCert,
-		// ClientCAs = certs used to validate client cert.
-		ClientCAs: nil,
-		// InsecureSkipVerify = verify that cert contents
-		// match server. IP matches what is in cert etc.
-		InsecureSkipVerify: true, //nolint:gosec
-		// // Certificates = list of certs client sends to server.
-		// Certificates: []tls.Certificate{cert},
-	}
-}
-
 type mqttConnectionConfig struct {
 	host     string
 	port     int
 	secure   bool
 	username string
 	password string
+	// vrmPortalID selects the VRM broker when no host is given
+	vrmPortalID string
+	// url overrides host, port and secure, for example to connect over websockets
+	url       *url.URL
+	headers   http.Header
+	tlsConfig *tls.Config
+	// credentials overrides username and password when set
+	credentials mqtt.CredentialsProvider
 }
 
-func connectWait(client mqtt.Client) error {
+var brokerURLSchemes = map[string]bool{"tcp": true, "ssl": true, "ws": true, "wss": true}
+
+func parseBrokerURL(s string) (*url.URL, error) {
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid broker url: %w", err)
+	}
+
+	if !brokerURLSchemes[u.Scheme] {
+		return nil, fmt.Errorf("unsupported broker url scheme %q, expected tcp, ssl, ws or wss", u.Scheme)
+	}
+
+	return u, nil
+}
+
+func (c mqttConnectionConfig) brokerHost() string {
+	if c.url != nil {
+		return c.url.Hostname()
+	}
+
+	if c.host == "" && c.vrmPortalID != "" {
+		return vrmBrokerHost(c.vrmPortalID)
+	}
+
+	return c.host
+}
+
+func (c mqttConnectionConfig) usesTLS() bool {
+	if c.url != nil {
+		return c.url.Scheme == "ssl" || c.url.Scheme == "wss"
+	}
+
+	return c.secure
+}
+
+func (c mqttConnectionConfig) brokerURL() string {
+	if c.url != nil {
+		return c.url.String()
+	}
+
+	if c.secure {
+		return fmt.Sprintf("ssl://%s:%d", c.brokerHost(), c.port)
+	}
+
+	return fmt.Sprintf("tcp://%s:%d", c.brokerHost(), c.port)
+}
+
+// connectWait connects client, giving up when ctx is done. An abandoned
+// attempt is given up to timeout to finish.
+func connectWait(ctx context.Context, client mqtt.Client, timeout time.Duration) error {
 	token := client.Connect()
-	for !token.WaitTimeout(3 * time.Second) {
+	select {
+	case <-token.Done():
+	case <-ctx.Done():
+		abandonConnect(client, token, timeout)
+
+		return fmt.Errorf("failed to connect to mqtt: %w", ctx.Err())
 	}
 
 	err := token.Error()
@@ -62,45 +96,113 @@ func connectWait(client mqtt.Client) error {
 	return nil
 }
 
-func connect(clientID string, config mqttConnectionConfig) (mqtt.Client, error) {
-	client := mqtt.NewClient(createClientOptions(clientID, config, nil))
+// abandonConnect tears down a connect attempt that is no longer wanted,
+// so that it can't later connect alongside a retry using the same client
+// ID. Paho carries on connecting in the background after Disconnect, so
+// the attempt is waited for and the client disconnected again if it
+// succeeded.
+func abandonConnect(client mqtt.Client, token mqtt.Token, timeout time.Duration) {
+	client.Disconnect(250)
+
+	if !token.WaitTimeout(timeout) {
+		// A broker that accepts the connection but never answers it
+		// holds the attempt open indefinitely
+		go func() {
+			<-token.Done()
+
+			if token.Error() == nil {
+				client.Disconnect(250)
+			}
+		}()
 
-	return client, connectWait(client)
+		return
+	}
+
+	if token.Error() == nil {
+		client.Disconnect(250)
+	}
+}
+
+// subscriptionTopics returns the topic filters needed to receive every
+// mapped path, or the whole bus when subscribeAll is set. Topics are
+// limited to a single portal when portalID is given.
+func subscriptionTopics(subscribeAll bool, writable bool, portalID string) map[string]byte {
+	prefix := "N/+/"
+	if portalID != "" {
+		prefix = "N/" + portalID + "/"
+	}
+
+	if subscribeAll {
+		if portalID != "" {
+			return map[string]byte{prefix + "#": 0}
+		}
+
+		return map[string]byte{"#": 0}
+	}
+
+	topics := map[string]byte{
+		prefix + "system/0/Serial":        0,
+		prefix + "full_publish_completed": 0,
+		prefix + "heartbeat":              0,
+	}
+
+	for path := range suffixTopicMap {
+		topics[prefix+"+/+/"+path] = 0
+	}
+
+	for path := range elementTopicMap {
+		topics[prefix+"+/+/"+path] = 0
+	}
+
+	// Writes are confirmed by the update that follows them
+	if writable {
+		for _, topic := range writableTopics(prefix) {
+			topics[topic] = 0
+		}
+	}
+
+	return topics
 }
 
-func listen(clientID string, config mqttConnectionConfig, topic string) error {
-	log.WithFields(log.Fields{
-		"host": config.host,
-		"port": config.port,
-	}).Debug("connecting to mqtt")
+// newSubscriptionClient creates the client that subscribes to topics for
+// a site. It needs to be connected with connectWait.
+func newSubscriptionClient(s *site, config mqttConnectionConfig, clientID string, topics map[string]byte) mqtt.Client {
+	s.logger().WithField("broker", config.brokerURL()).Debug("connecting to mqtt")
 
 	onConnect := func(client mqtt.Client) {
-		log.Info("mqtt connected, subscribing to topics...")
+		s.logger().WithField("topics", len(topics)).Info("mqtt connected, subscribing to topics...")
+		s.keepalive.requestFullPublish()
 		// We need to subscribe after each connection
 		// since mqtt does not maintain subscriptions across reconnects
-		client.Subscribe(topic, 0, mqttSubscriptionHandler)
+		token := client.SubscribeMultiple(topics, newSubscriptionHandler(s))
+		go func() {
+			token.Wait()
+			if err := token.Error(); err != nil {
+				s.logger().WithError(err).Error("mqtt subscribe failed")
+			}
+		}()
 	}
 
-	client := mqtt.NewClient(createClientOptions(clientID, config, onConnect))
-
-	return connectWait(client)
+	return mqtt.NewClient(createClientOptions(s.name, clientID, config, s.opts.connectTimeout, onConnect))
 }
 
-func newConnectionLostHandler(clientID string) mqtt.ConnectionLostHandler {
+func newConnectionLostHandler(siteName string, clientID string) mqtt.ConnectionLostHandler {
 	return func(c mqtt.Client, e error) {
 		log.WithFields(log.Fields{
+			"site":      siteName,
 			"client_id": clientID,
 		}).WithError(e).Error("mqtt connection lost")
-		connectionStatus.WithLabelValues(clientID).Set(0)
-		connectionStatusSinceTimeSeconds.WithLabelValues(clientID).Set(float64(time.Now().Unix()))
+		connections.set(siteName, clientID, false)
 	}
 }
 
-func newConnectionHandler(clientID string, wrapped mqtt.OnConnectHandler) mqtt.OnConnectHandler {
+func newConnectionHandler(siteName string, clientID string, wrapped mqtt.OnConnectHandler) mqtt.OnConnectHandler {
 	return func(c mqtt.Client) {
-		log.WithField("client_id", clientID).Info("mqtt connected")
-		connectionStatus.WithLabelValues(clientID).Set(1)
-		connectionStatusSinceTimeSeconds.WithLabelValues(clientID).Set(float64(time.Now().Unix()))
+		log.WithFields(log.Fields{
+			"site":      siteName,
+			"client_id": clientID,
+		}).Info("mqtt connected")
+		connections.set(siteName, clientID, true)
 
 		if wrapped != nil {
 			wrapped(c)
@@ -108,20 +210,24 @@ func newConnectionHandler(clientID string, wrapped mqtt.OnConnectHandler) mqtt.O
 	}
 }
 
-func createClientOptions(clientID string, config mqttConnectionConfig, onConnectionHandler mqtt.OnConnectHandler) *mqtt.ClientOptions {
+func createClientOptions(siteName string, clientID string, config mqttConnectionConfig, connectTimeout time.Duration, onConnectionHandler mqtt.OnConnectHandler) *mqtt.ClientOptions {
 	opts := mqtt.NewClientOptions()
 	opts.SetAutoReconnect(true)
 	opts.SetMaxReconnectInterval(1 * time.Minute)
 	opts.SetWriteTimeout(30 * time.Second)
+	// Bounds a connect attempt that is abandoned by connectWait
+	opts.SetConnectTimeout(connectTimeout)
 	opts.SetOrderMatters(false)
-	opts.SetConnectionLostHandler(newConnectionLostHandler(clientID))
-	opts.SetOnConnectHandler(newConnectionHandler(clientID, onConnectionHandler))
+	opts.SetConnectionLostHandler(newConnectionLostHandler(siteName, clientID))
+	opts.SetOnConnectHandler(newConnectionHandler(siteName, clientID, onConnectionHandler))
+
+	opts.AddBroker(config.brokerURL())
+	if config.usesTLS() {
+		opts.SetTLSConfig(config.tlsConfig)
+	}
 
-	if config.secure {
-		opts.AddBroker(fmt.Sprintf("ssl://%s:%d", config.host, config.port))
-		opts.SetTLSConfig(newTLSConfig())
-	} else {
-		opts.AddBroker(fmt.Sprintf("tcp://%s:%d", config.host, config.port))
+	if len(config.headers) > 0 {
+		opts.SetHTTPHeaders(config.headers)
 	}
 
 	if config.username != "" {
@@ -132,6 +238,10 @@ func createClientOptions(clientID string, config mqttConnectionConfig, onConnect
 		opts.SetPassword(config.password)
 	}
 
+	if config.credentials != nil {
+		opts.SetCredentialsProvider(config.credentials)
+	}
+
 	opts.SetClientID(clientID)
 	opts.SetCleanSession(true)
 
@@ -142,17 +252,77 @@ type victronValue struct {
 	Value *float64 `json:"value"`
 }
 
-type victronStringValue struct {
-	Value *string `json:"value"`
+// Reasons for which subscription updates are ignored
+const (
+	ignoreReasonShortTopic      = "short_topic"
+	ignoreReasonNotNotification = "not_notification"
+	ignoreReasonOtherPortal     = "other_portal"
+	ignoreReasonUnmapped        = "unmapped"
+	ignoreReasonInvalidJSON     = "invalid_json"
+	ignoreReasonFiltered        = "filtered"
+)
+
+func newSubscriptionHandler(s *site) mqtt.MessageHandler {
+	return func(client mqtt.Client, msg mqtt.Message) {
+		s.handleMessage(msg, time.Now())
+	}
 }
 
-func mqttSubscriptionHandler(client mqtt.Client, msg mqtt.Message) {
-	subscriptionsUpdatesTotal.Inc()
+// handleMessage exports a message received at receivedAt, which is the
+// recorded time when a recording is replayed.
+func (s *site) handleMessage(msg mqtt.Message, receivedAt time.Time) {
+	start := time.Now()
+	defer func() {
+		messageHandlerDurationSeconds.WithLabelValues(s.name).Observe(time.Since(start).Seconds())
+	}()
+
+	subscriptionsUpdatesTotal.WithLabelValues(s.name).Inc()
+	messagePayloadBytes.WithLabelValues(s.name).Observe(float64(len(msg.Payload())))
+
+	if s.opts.recorder != nil {
+		s.opts.recorder.record(s.name, msg, receivedAt)
+	}
 
 	topic := msg.Topic()
 	topicParts := strings.Split(topic, "/")
+	if len(topicParts) < 3 {
+		subscriptionsUpdatesIgnoredTotal.WithLabelValues(s.name, ignoreReasonShortTopic).Inc()
+
+		return
+	}
+
+	if topicParts[0] != "N" {
+		subscriptionsUpdatesIgnoredTotal.WithLabelValues(s.name, ignoreReasonNotNotification).Inc()
+
+		return
+	}
+
+	portalID := topicParts[1]
+	if !s.portal.accepts(portalID) {
+		subscriptionsUpdatesIgnoredTotal.WithLabelValues(s.name, ignoreReasonOtherPortal).Inc()
+
+		return
+	}
+
+	s.messageReceived(receivedAt)
+
+	if len(topicParts) >= 4 {
+		messagesReceivedTotal.WithLabelValues(s.name, topicParts[2]).Inc()
+	}
+
+	if len(topicParts) == 3 && topicParts[2] == "full_publish_completed" {
+		s.keepalive.fullPublishCompleted()
+
+		return
+	}
+
+	// Heartbeats only serve to show that data is still flowing
+	if len(topicParts) == 3 && topicParts[2] == "heartbeat" {
+		return
+	}
+
 	if len(topicParts) < 5 {
-		subscriptionsUpdatesIgnoredTotal.Inc()
+		subscriptionsUpdatesIgnoredTotal.WithLabelValues(s.name, ignoreReasonShortTopic).Inc()
 
 		return
 	}
@@ -163,44 +333,97 @@ func mqttSubscriptionHandler(client mqtt.Client, msg mqtt.Message) {
 
 	topicString := strings.Join(topicInfoParts, "/")
 
-	if (topicString == "Serial") && (systemSerialID == "") {
-		var v victronStringValue
+	if componentType == "system" && componentID == "0" && topicString == "Serial" {
+		if s.portal.set(portalID) {
+			s.keepalive.requestFullPublish()
+		}
+
+		return
+	}
 
-		err := json.Unmarshal(msg.Payload(), &v)
-		if err != nil {
-			log.Warn("failed to unmarshal victron mqtt payload: ", err)
-			subscriptionsUpdatesIgnoredTotal.Inc()
+	s.writes.notify(componentType+"/"+componentID+"/"+topicString, msg.Payload())
+
+	o, ok := suffixTopicMap[topicString]
+	e, expands := elementTopicMap[topicString]
+
+	if !ok && !expands {
+		if filteredPaths[topicString] {
+			subscriptionsUpdatesIgnoredTotal.WithLabelValues(s.name, ignoreReasonFiltered).Inc()
 
 			return
 		}
 
-		if v.Value != nil {
-			systemSerialID = *v.Value
-		}
+		unmapped.record(componentType, topicString, msg.Payload(), receivedAt)
+		subscriptionsUpdatesIgnoredTotal.WithLabelValues(s.name, ignoreReasonUnmapped).Inc()
 
 		return
 	}
 
-	o, ok := suffixTopicMap[topicString]
-	if !ok {
-		subscriptionsUpdatesIgnoredTotal.Inc()
+	name := o.name
+	if expands {
+		name = e.name
+	}
+
+	if !filters.keep(name, componentType, componentID, topicString) {
+		subscriptionsUpdatesIgnoredTotal.WithLabelValues(s.name, ignoreReasonFiltered).Inc()
 
 		return
 	}
 
-	var v victronValue
-
-	err := json.Unmarshal(msg.Payload(), &v)
+	v, err := decodePayload(msg.Payload())
 	if err != nil {
-		log.Warn("failed to unmarshal victron mqtt payload: ", err)
-		subscriptionsUpdatesIgnoredTotal.Inc()
+		log.WithField("topic", topic).WithError(err).Debug("failed to decode victron mqtt payload")
+		subscriptionsUpdatesIgnoredTotal.WithLabelValues(s.name, ignoreReasonInvalidJSON).Inc()
+
+		return
+	}
+
+	t := transformTopicMap[topicString]
+
+	switch {
+	case ok && (v.shape == shapeNumber || v.shape == shapeBool || v.shape == shapeNull):
+		if v.shape == shapeNull {
+			subscriptionsUpdatesNullTotal.WithLabelValues(s.name).Inc()
+		}
+
+		if t != nil {
+			v.value = t.apply(v.value)
+		}
+
+		o.observe(s.name, portalID, componentType, componentID, v.value)
+		o.collector.updated(receivedAt, s.name, portalID, componentType, componentID)
+	case expands && (v.shape == shapeArray || v.shape == shapeObject):
+		for key, value := range v.elements {
+			if t != nil {
+				value = t.apply(value)
+			}
+
+			e.observe(s.name, portalID, componentType, componentID, key, value)
+			e.collector.updated(receivedAt, s.name, portalID, componentType, componentID, key)
+		}
+	default:
+		subscriptionsUpdatesUnsupportedTotal.WithLabelValues(s.name, v.shape).Inc()
 
 		return
 	}
 
-	if v.Value == nil {
-		o(componentType, componentID, math.NaN())
-	} else {
-		o(componentType, componentID, *v.Value)
+	subscriptionsUpdatesMappedTotal.WithLabelValues(s.name).Inc()
+
+	if *lastUpdateTimestamps {
+		lastUpdateTimestampSeconds.WithLabelValues(s.name, portalID, componentType, componentID, topicString).
+			Set(float64(receivedAt.UnixNano()) / 1e9)
 	}
 }
+
+// isNumber reports whether a topic segment is a number, such as a device
+// instance. Only ASCII digits count, as only they can appear in a topic
+// the GX accepts.
+func isNumber(segment string) bool {
+	for _, r := range segment {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+
+	return segment != ""
+}
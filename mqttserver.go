@@ -0,0 +1,518 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// MQTT 3.1.1 control packet types
+const (
+	mqttConnect     = 1
+	mqttConnack     = 2
+	mqttPublish     = 3
+	mqttPuback      = 4
+	mqttPubrec      = 5
+	mqttPubrel      = 6
+	mqttPubcomp     = 7
+	mqttSubscribe   = 8
+	mqttSuback      = 9
+	mqttUnsubscribe = 10
+	mqttUnsuback    = 11
+	mqttPingreq     = 12
+	mqttPingresp    = 13
+	mqttDisconnect  = 14
+)
+
+// mqttMaxPacketSize bounds the packets accepted from clients.
+const mqttMaxPacketSize = 1 << 20
+
+// mqttServer is a minimal in-process MQTT 3.1.1 broker, enough for the
+// simulator to be used by the exporter and other clients. Messages are
+// delivered to subscribers at QoS 0, and any credentials are accepted.
+// Publishes at QoS 2 are refused by closing the connection, as their
+// acknowledgement flow isn't tracked.
+type mqttServer struct {
+	// onPublish is called for every message that a client publishes
+	onPublish func(topic string, payload []byte)
+	// acceptConnect, if set, decides whether a client may connect.
+	// Refused clients are told that the server is unavailable.
+	acceptConnect func(clientID string) bool
+
+	mu       sync.RWMutex
+	clients  map[*mqttServerClient]struct{}
+	retained map[string][]byte
+}
+
+type mqttServerClient struct {
+	conn net.Conn
+	id   string
+
+	writeMu sync.Mutex
+
+	mu            sync.RWMutex
+	subscriptions map[string]struct{}
+}
+
+func newMQTTServer(onPublish func(topic string, payload []byte)) *mqttServer {
+	return &mqttServer{
+		onPublish: onPublish,
+		clients:   map[*mqttServerClient]struct{}{},
+		retained:  map[string][]byte{},
+	}
+}
+
+// serve accepts connections on l until ctx is done.
+func (s *mqttServer) serve(ctx context.Context, l net.Listener) error {
+	go func() {
+		<-ctx.Done()
+		l.Close()
+
+		s.mu.RLock()
+		defer s.mu.RUnlock()
+
+		for c := range s.clients {
+			c.conn.Close()
+		}
+	}()
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+
+			return err
+		}
+
+		go s.handle(conn)
+	}
+}
+
+// publish sends a message to every client subscribed to topic. Retained
+// messages are also sent to clients that subscribe later, and an empty
+// retained message clears the one retained for topic.
+func (s *mqttServer) publish(topic string, payload []byte, retain bool) {
+	s.mu.Lock()
+	switch {
+	case retain && len(payload) == 0:
+		delete(s.retained, topic)
+	case retain:
+		s.retained[topic] = payload
+	}
+
+	clients := make([]*mqttServerClient, 0, len(s.clients))
+	for c := range s.clients {
+		clients = append(clients, c)
+	}
+	s.mu.Unlock()
+
+	for _, c := range clients {
+		if c.subscribed(topic) {
+			c.send(topic, payload, retain)
+		}
+	}
+}
+
+func (s *mqttServer) handle(conn net.Conn) {
+	c := &mqttServerClient{conn: conn, subscriptions: map[string]struct{}{}}
+	logger := log.WithField("remote_addr", conn.RemoteAddr().String())
+
+	defer conn.Close()
+
+	r := bufio.NewReader(conn)
+
+	packetType, _, body, err := readMQTTPacket(r)
+	if err != nil || packetType != mqttConnect {
+		logger.WithError(err).Debug("mqtt client did not connect")
+
+		return
+	}
+
+	keepalive, err := c.connect(body, s.acceptConnect)
+	if err != nil {
+		logger.WithError(err).Debug("invalid mqtt connect")
+
+		return
+	}
+
+	logger = logger.WithField("client_id", c.id)
+	logger.Debug("mqtt client connected")
+
+	s.mu.Lock()
+	s.clients[c] = struct{}{}
+	s.mu.Unlock()
+
+	defer func() {
+		s.mu.Lock()
+		delete(s.clients, c)
+		s.mu.Unlock()
+
+		logger.Debug("mqtt client disconnected")
+	}()
+
+	for {
+		if keepalive > 0 {
+			_ = conn.SetReadDeadline(time.Now().Add(keepalive * 3 / 2))
+		}
+
+		packetType, flags, body, err := readMQTTPacket(r)
+		if err != nil {
+			if !errors.Is(err, io.EOF) {
+				logger.WithError(err).Debug("failed to read mqtt packet")
+			}
+
+			return
+		}
+
+		switch packetType {
+		case mqttPublish:
+			err = s.handlePublish(c, flags, body)
+		case mqttSubscribe:
+			err = s.handleSubscribe(c, body)
+		case mqttUnsubscribe:
+			err = c.unsubscribe(body)
+		case mqttPingreq:
+			err = c.write(mqttPingresp<<4, nil)
+		case mqttDisconnect:
+			return
+		}
+
+		if err != nil {
+			logger.WithError(err).Debug("closing mqtt connection")
+
+			return
+		}
+	}
+}
+
+// connect reads a CONNECT packet, replies with CONNACK and returns the
+// client's keepalive interval. accept, if set, may refuse the client.
+func (c *mqttServerClient) connect(body []byte, accept func(clientID string) bool) (time.Duration, error) {
+	// The will, username and password that may follow are ignored
+	p := mqttPacketReader{b: body}
+	protocol := p.string()
+	level := p.byte()
+	p.byte()
+	keepalive := p.uint16()
+	c.id = p.string()
+
+	if p.err != nil {
+		return 0, p.err
+	}
+
+	if (protocol != "MQTT" || level != 4) && (protocol != "MQIsdp" || level != 3) {
+		// Unacceptable protocol version
+		_ = c.write(mqttConnack<<4, []byte{0, 1})
+
+		return 0, fmt.Errorf("unsupported protocol %s level %d", protocol, level)
+	}
+
+	if accept != nil && !accept(c.id) {
+		// Server unavailable
+		_ = c.write(mqttConnack<<4, []byte{0, 3})
+
+		return 0, errors.New("connection refused")
+	}
+
+	return time.Duration(keepalive) * time.Second, c.write(mqttConnack<<4, []byte{0, 0})
+}
+
+func (s *mqttServer) handlePublish(c *mqttServerClient, flags byte, body []byte) error {
+	p := mqttPacketReader{b: body}
+	topic := p.string()
+	qos := (flags >> 1) & 0x03
+
+	var id []byte
+	if qos > 0 {
+		id = p.bytes(2)
+	}
+
+	if p.err != nil {
+		return p.err
+	}
+
+	payload := p.rest()
+
+	switch qos {
+	case 1:
+		err := c.write(mqttPuback<<4, id)
+		if err != nil {
+			return err
+		}
+	case 2:
+		return errors.New("QoS 2 publishes are not supported")
+	case 3:
+		return errors.New("invalid QoS 3")
+	}
+
+	s.publish(topic, payload, flags&0x01 != 0)
+
+	if s.onPublish != nil {
+		s.onPublish(topic, payload)
+	}
+
+	return nil
+}
+
+func (s *mqttServer) handleSubscribe(c *mqttServerClient, body []byte) error {
+	p := mqttPacketReader{b: body}
+	id := p.bytes(2)
+
+	var filters []string
+
+	for len(p.b) > 0 && p.err == nil {
+		filters = append(filters, p.string())
+		p.byte()
+	}
+
+	if p.err != nil {
+		return p.err
+	}
+
+	c.mu.Lock()
+	for _, f := range filters {
+		c.subscriptions[f] = struct{}{}
+	}
+	c.mu.Unlock()
+
+	// Every subscription is granted at QoS 0
+	err := c.write(mqttSuback<<4, append(id, make([]byte, len(filters))...))
+	if err != nil {
+		return err
+	}
+
+	// The retained messages are sent once the lock is released, so that a
+	// slow client doesn't hold up publishing
+	s.mu.RLock()
+	retained := map[string][]byte{}
+
+	for topic, payload := range s.retained {
+		for _, f := range filters {
+			if mqttTopicMatches(f, topic) {
+				retained[topic] = payload
+
+				break
+			}
+		}
+	}
+	s.mu.RUnlock()
+
+	for topic, payload := range retained {
+		c.send(topic, payload, true)
+	}
+
+	return nil
+}
+
+func (c *mqttServerClient) unsubscribe(body []byte) error {
+	p := mqttPacketReader{b: body}
+	id := p.bytes(2)
+
+	c.mu.Lock()
+	for len(p.b) > 0 && p.err == nil {
+		delete(c.subscriptions, p.string())
+	}
+	c.mu.Unlock()
+
+	if p.err != nil {
+		return p.err
+	}
+
+	return c.write(mqttUnsuback<<4, id)
+}
+
+func (c *mqttServerClient) subscribed(topic string) bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	for f := range c.subscriptions {
+		if mqttTopicMatches(f, topic) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// send delivers a message to the client at QoS 0. Clients that can't
+// keep up are disconnected.
+func (c *mqttServerClient) send(topic string, payload []byte, retain bool) {
+	body := make([]byte, 0, 2+len(topic)+len(payload))
+	body = append(body, byte(len(topic)>>8), byte(len(topic)))
+	body = append(body, topic...)
+	body = append(body, payload...)
+
+	var flags byte
+	if retain {
+		flags = 0x01
+	}
+
+	err := c.write(mqttPublish<<4|flags, body)
+	if err != nil {
+		c.conn.Close()
+	}
+}
+
+func (c *mqttServerClient) write(header byte, body []byte) error {
+	packet := []byte{header}
+	packet = appendMQTTLength(packet, len(body))
+	packet = append(packet, body...)
+
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	_ = c.conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+	_, err := c.conn.Write(packet)
+
+	return err
+}
+
+func appendMQTTLength(b []byte, n int) []byte {
+	for {
+		digit := byte(n % 128)
+		n /= 128
+
+		if n > 0 {
+			digit |= 0x80
+		}
+
+		b = append(b, digit)
+
+		if n == 0 {
+			return b
+		}
+	}
+}
+
+// readMQTTPacket reads a control packet, returning its type, flags and
+// the rest of the packet after the fixed header.
+func readMQTTPacket(r *bufio.Reader) (byte, byte, []byte, error) {
+	header, err := r.ReadByte()
+	if err != nil {
+		return 0, 0, nil, err
+	}
+
+	length, multiplier := 0, 1
+
+	for i := 0; ; i++ {
+		if i == 4 {
+			return 0, 0, nil, errors.New("malformed remaining length")
+		}
+
+		digit, err := r.ReadByte()
+		if err != nil {
+			return 0, 0, nil, err
+		}
+
+		length += int(digit&0x7f) * multiplier
+		multiplier *= 128
+
+		if digit&0x80 == 0 {
+			break
+		}
+	}
+
+	if length > mqttMaxPacketSize {
+		return 0, 0, nil, fmt.Errorf("packet of %d bytes is too large", length)
+	}
+
+	body := make([]byte, length)
+
+	_, err = io.ReadFull(r, body)
+	if err != nil {
+		return 0, 0, nil, err
+	}
+
+	return header >> 4, header & 0x0f, body, nil
+}
+
+// mqttPacketReader decodes the fields of a packet, recording the first
+// error rather than returning one from each call.
+type mqttPacketReader struct {
+	b   []byte
+	err error
+}
+
+func (p *mqttPacketReader) bytes(n int) []byte {
+	if p.err != nil {
+		return nil
+	}
+
+	if len(p.b) < n {
+		p.err = errors.New("packet too short")
+
+		return nil
+	}
+
+	b := p.b[:n]
+	p.b = p.b[n:]
+
+	return b
+}
+
+func (p *mqttPacketReader) byte() byte {
+	b := p.bytes(1)
+	if b == nil {
+		return 0
+	}
+
+	return b[0]
+}
+
+func (p *mqttPacketReader) uint16() uint16 {
+	b := p.bytes(2)
+	if b == nil {
+		return 0
+	}
+
+	return binary.BigEndian.Uint16(b)
+}
+
+func (p *mqttPacketReader) string() string {
+	return string(p.bytes(int(p.uint16())))
+}
+
+func (p *mqttPacketReader) rest() []byte {
+	b := p.b
+	p.b = nil
+
+	return b
+}
+
+// mqttTopicMatches reports whether topic matches the subscription filter,
+// which may contain + and # wildcards.
+func mqttTopicMatches(filter string, topic string) bool {
+	if strings.HasPrefix(topic, "$") && !strings.HasPrefix(filter, "$") {
+		return false
+	}
+
+	filterParts := strings.Split(filter, "/")
+	topicParts := strings.Split(topic, "/")
+
+	for i, f := range filterParts {
+		if f == "#" {
+			return true
+		}
+
+		if i >= len(topicParts) {
+			return false
+		}
+
+		if f != "+" && f != topicParts[i] {
+			return false
+		}
+	}
+
+	return len(filterParts) == len(topicParts)
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAppendMQTTLength(t *testing.T) {
+	tests := []struct {
+		n    int
+		want []byte
+	}{
+		{0, []byte{0x00}},
+		{127, []byte{0x7f}},
+		{128, []byte{0x80, 0x01}},
+		{16383, []byte{0xff, 0x7f}},
+		{16384, []byte{0x80, 0x80, 0x01}},
+		{2097151, []byte{0xff, 0xff, 0x7f}},
+		{2097152, []byte{0x80, 0x80, 0x80, 0x01}},
+		{268435455, []byte{0xff, 0xff, 0xff, 0x7f}},
+	}
+
+	for _, tt := range tests {
+		got := appendMQTTLength(nil, tt.n)
+		if !bytes.Equal(got, tt.want) {
+			t.Errorf("appendMQTTLength(%d) = %x, want %x", tt.n, got, tt.want)
+		}
+	}
+}
+
+func TestReadMQTTPacket(t *testing.T) {
+	body := bytes.Repeat([]byte{0xab}, 200)
+
+	packet := []byte{mqttPublish<<4 | 0x03}
+	packet = appendMQTTLength(packet, len(body))
+	packet = append(packet, body...)
+	packet = append(packet, mqttPingreq<<4, 0x00)
+
+	r := bufio.NewReader(bytes.NewReader(packet))
+
+	packetType, flags, got, err := readMQTTPacket(r)
+	if err != nil {
+		t.Fatalf("readMQTTPacket() error = %v", err)
+	}
+
+	if packetType != mqttPublish || flags != 0x03 || !bytes.Equal(got, body) {
+		t.Errorf("readMQTTPacket() = %d, %x, %d bytes, want %d, 3, %d bytes", packetType, flags, len(got), mqttPublish, len(body))
+	}
+
+	packetType, _, got, err = readMQTTPacket(r)
+	if err != nil {
+		t.Fatalf("readMQTTPacket() error = %v", err)
+	}
+
+	if packetType != mqttPingreq || len(got) != 0 {
+		t.Errorf("readMQTTPacket() = %d, %d bytes, want %d, 0 bytes", packetType, len(got), mqttPingreq)
+	}
+}
+
+func TestReadMQTTPacketErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		packet []byte
+	}{
+		{"empty", nil},
+		{"missing length", []byte{mqttPublish << 4}},
+		{"five byte length", []byte{mqttPublish << 4, 0x80, 0x80, 0x80, 0x80, 0x01}},
+		{"too large", appendMQTTLength([]byte{mqttPublish << 4}, mqttMaxPacketSize+1)},
+		{"truncated body", []byte{mqttPublish << 4, 0x04, 0x00, 0x01}},
+	}
+
+	for _, tt := range tests {
+		_, _, _, err := readMQTTPacket(bufio.NewReader(bytes.NewReader(tt.packet)))
+		if err == nil {
+			t.Errorf("%s: readMQTTPacket() succeeded, want an error", tt.name)
+		}
+	}
+}
+
+func TestMQTTTopicMatches(t *testing.T) {
+	tests := []struct {
+		filter string
+		topic  string
+		want   bool
+	}{
+		{"N/c0619ab12345/system/0/Serial", "N/c0619ab12345/system/0/Serial", true},
+		{"N/c0619ab12345/system/0/Serial", "N/c0619ab12345/system/0", false},
+		{"N/+/system/0/Serial", "N/c0619ab12345/system/0/Serial", true},
+		{"N/+/+/+/Dc/0/Voltage", "N/c0619ab12345/battery/512/Dc/0/Voltage", true},
+		{"N/+/+/+/Dc/0/Voltage", "N/c0619ab12345/battery/512/Dc/1/Voltage", false},
+		{"N/+/heartbeat", "N/c0619ab12345/system/heartbeat", false},
+		{"N/c0619ab12345/#", "N/c0619ab12345/battery/512/Soc", true},
+		{"N/c0619ab12345/#", "N/c0619ab12345", true},
+		{"N/c0619ab12345/#", "N/other/battery/512/Soc", false},
+		{"#", "N/c0619ab12345/heartbeat", true},
+		{"#", "$SYS/broker/uptime", false},
+		{"$SYS/#", "$SYS/broker/uptime", true},
+		{"+/+", "N/c0619ab12345/heartbeat", false},
+	}
+
+	for _, tt := range tests {
+		got := mqttTopicMatches(tt.filter, tt.topic)
+		if got != tt.want {
+			t.Errorf("mqttTopicMatches(%q, %q) = %t, want %t", tt.filter, tt.topic, got, tt.want)
+		}
+	}
+}
+
+func TestMQTTServerClearsRetained(t *testing.T) {
+	s := newMQTTServer(nil)
+
+	s.publish("N/c0619ab12345/system/0/Serial", []byte(`{"value": "c0619ab12345"}`), true)
+	if _, ok := s.retained["N/c0619ab12345/system/0/Serial"]; !ok {
+		t.Fatal("retained message not stored")
+	}
+
+	s.publish("N/c0619ab12345/system/0/Serial", nil, true)
+	if _, ok := s.retained["N/c0619ab12345/system/0/Serial"]; ok {
+		t.Error("empty retained message did not clear the retained topic")
+	}
+}
+
+// startTestBroker serves s on a local port until the test ends, and
+// returns its URL.
+func startTestBroker(t *testing.T, s *mqttServer) string {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	go func() { _ = s.serve(ctx, l) }()
+
+	return "tcp://" + l.Addr().String()
+}
+
+// testSiteOptions are the options for sites in tests.
+var testSiteOptions = siteOptions{
+	clientPrefix:     "test",
+	keepaliveMode:    keepaliveModeAuto,
+	pollInterval:     100 * time.Millisecond,
+	connectTimeout:   2 * time.Second,
+	watchdogTimeout:  time.Minute,
+	failoverTimeout:  time.Minute,
+	failbackInterval: time.Hour,
+}
+
+// newTestSite returns a site connecting to the broker at url.
+func newTestSite(t *testing.T, name string, url string) *site {
+	t.Helper()
+
+	s, err := newSite(siteConfig{
+		Name:           name,
+		brokerSettings: brokerSettings{URL: url},
+	}, testSiteOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { deleteSiteMetrics(name) })
+
+	return s
+}
+
+// waitFor polls cond until it is true or a few seconds have passed.
+func waitFor(cond func() bool) bool {
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(20 * time.Millisecond) {
+		if cond() {
+			return true
+		}
+	}
+
+	return cond()
+}
+
+// mqttString encodes s as a length-prefixed MQTT string.
+func mqttString(s string) []byte {
+	return append([]byte{byte(len(s) >> 8), byte(len(s))}, s...)
+}
+
+func TestMQTTServerRejectsQoS2(t *testing.T) {
+	published := make(chan string, 1)
+	s := newMQTTServer(func(topic string, payload []byte) { published <- topic })
+	url := startTestBroker(t, s)
+
+	conn, err := net.Dial("tcp", strings.TrimPrefix(url, "tcp://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	connect := append(mqttString("MQTT"), 4, 0x02, 0, 0)
+	connect = append(connect, mqttString("qos2")...)
+
+	publish := append(mqttString("R/c0619ab12345/keepalive"), 0, 1)
+
+	for _, packet := range []struct {
+		header byte
+		body   []byte
+	}{
+		{mqttConnect << 4, connect},
+		{mqttPublish<<4 | 2<<1, publish},
+	} {
+		_, err = conn.Write(append(appendMQTTLength([]byte{packet.header}, len(packet.body)), packet.body...))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	r := bufio.NewReader(conn)
+
+	packetType, _, _, err := readMQTTPacket(r)
+	if err != nil || packetType != mqttConnack {
+		t.Fatalf("readMQTTPacket() = %d, %v, want a CONNACK", packetType, err)
+	}
+
+	packetType, _, _, err = readMQTTPacket(r)
+	if err == nil {
+		t.Errorf("read packet %d after a QoS 2 publish, want the connection closed", packetType)
+	}
+
+	select {
+	case topic := <-published:
+		t.Errorf("QoS 2 publish to %s was passed on", topic)
+	default:
+	}
+}
@@ -0,0 +1,424 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// Metric naming schemes
+const (
+	// namingLegacy exports the original metric names
+	namingLegacy = "legacy"
+	// namingPrometheus exports names following the Prometheus conventions:
+	// base units, _total counters and ratios rather than percentages
+	namingPrometheus = "prometheus"
+	// namingBoth exports both, so that dashboards can be migrated
+	namingBoth = "both"
+)
+
+// metricRename is the Prometheus convention name for a metric exported
+// under a legacy name.
+type metricRename struct {
+	name string
+	// scale converts the value to base units. 0 leaves it unchanged.
+	scale float64
+	// counter exports the metric as a counter. The value is published by
+	// the GX as a running total, so it is exported as is.
+	counter bool
+	// help is the help text in the new units, replacing the legacy one
+	help string
+}
+
+const (
+	kilowattHoursToJoules = 3.6e6
+	ampereHoursToCoulombs = 3600
+	percentToRatio        = 0.01
+)
+
+// metricRenames maps legacy metric names, without the victron_ prefix, to
+// their Prometheus convention names. Metrics that already follow the
+// conventions aren't listed.
+var metricRenames = map[string]metricRename{
+	"ac_active_input_phase__freq_hz": {
+		name: "ac_active_input_phase_frequency_hertz",
+		help: "Frequency of the active AC input in Hz",
+	},
+	"ac_active_input_phase_current_amps": {
+		name: "ac_active_input_phase_current_amperes",
+		help: "Current of the active AC input in A",
+	},
+	"ac_current_amps": {
+		name: "ac_current_amperes",
+		help: "AC current in A - Deprecated",
+	},
+	"ac_energy_forward_kwh": {
+		name:    "ac_energy_forward_joules_total",
+		scale:   kilowattHoursToJoules,
+		counter: true,
+		help:    "Total energy produced over all phases in J",
+	},
+	"ac_energy_phase_reverse_kwh": {
+		name:    "ac_phase_energy_reverse_joules_total",
+		scale:   kilowattHoursToJoules,
+		counter: true,
+		help:    "Total energy fed back per phase in J",
+	},
+	"ac_energy_reverse_kwh": {
+		name:    "ac_energy_reverse_joules_total",
+		scale:   kilowattHoursToJoules,
+		counter: true,
+		help:    "Total energy fed back over all phases in J",
+	},
+	"ac_grid_phase_power_watt": {
+		name: "ac_grid_phase_power_watts",
+		help: "Grid power per phase in W",
+	},
+	"ac_input_current_limit": {
+		name: "ac_input_current_limit_amperes",
+		help: "Current limit of each AC input in A",
+	},
+	"ac_input_current_limit_watts": {
+		name: "ac_in_current_limit_amperes",
+		help: "AC input current limit in A",
+	},
+	"ac_input_phase_current_amps": {
+		name: "ac_input_phase_current_amperes",
+		help: "AC input current per phase in A",
+	},
+	"ac_output_phase_current_amps": {
+		name: "ac_output_phase_current_amperes",
+		help: "AC output current per phase in A",
+	},
+	"ac_output_phase_freq_hz": {
+		name: "ac_output_phase_frequency_hertz",
+		help: "AC output frequency per phase in Hz",
+	},
+	"ac_output_phase_volts": {
+		name: "ac_output_phase_voltage_volts",
+		help: "AC output voltage per phase in V",
+	},
+	"ac_phase_current": {
+		name: "ac_phase_current_amperes",
+		help: "AC current per phase in A",
+	},
+	"ac_phase_current_amps": {
+		name: "ac_phase_current_amperes",
+		help: "AC current per phase in A",
+	},
+	"ac_phase_energy_forward_kwh": {
+		name:    "ac_phase_energy_forward_joules_total",
+		scale:   kilowattHoursToJoules,
+		counter: true,
+		help:    "Total energy produced per phase in J",
+	},
+	"battery_low_voltage": {
+		name: "battery_low_voltage_volts",
+		help: "Low voltage limit of the battery in V, which is ignored by the system (BYD, Lynx BMS and FreedomWon)",
+	},
+	"consumed_amphours": {
+		name:  "consumed_coulombs",
+		scale: ampereHoursToCoulombs,
+		help:  "Charge consumed in C",
+	},
+	"dc_battery_consumed_amphours": {
+		name:  "dc_battery_consumed_coulombs",
+		scale: ampereHoursToCoulombs,
+		help:  "Battery charge consumed in C",
+	},
+	"dc_battery_current": {
+		name: "dc_battery_current_amperes",
+		help: "Battery current in A",
+	},
+	"dc_battery_state_of_charge": {
+		name:  "dc_battery_state_of_charge_ratio",
+		scale: percentToRatio,
+		help:  "Battery state of charge, 0 to 1",
+	},
+	"dc_current_amps": {
+		name: "dc_current_amperes",
+		help: "DC current in A",
+	},
+	"dc_midvoltage_deviation_percent": {
+		name:  "dc_midvoltage_deviation_ratio",
+		scale: percentToRatio,
+		help:  "Midpoint voltage deviation as a ratio",
+	},
+	"dc_pv_current_amps": {
+		name: "dc_pv_current_amperes",
+		help: "PV current in A",
+	},
+	"dc_vebus_current_amps": {
+		name: "dc_vebus_current_amperes",
+		help: "VE.Bus DC current in A",
+	},
+	"diagnostics_shutdowns_due_to_error_count": {
+		name:    "diagnostics_shutdowns_due_to_error_total",
+		counter: true,
+		help:    "Number of shutdowns due to an error",
+	},
+	"history_automatic_syncs": {
+		name:    "history_automatic_syncs_total",
+		counter: true,
+		help:    "Number of automatic synchronisations",
+	},
+	"history_avg_discharge": {
+		name:  "history_average_discharge_coulombs",
+		scale: ampereHoursToCoulombs,
+		help:  "Average discharge in C",
+	},
+	"history_charge_cycles": {
+		name:    "history_charge_cycles_total",
+		counter: true,
+		help:    "Number of charge cycles",
+	},
+	"history_charged_energy_kwh": {
+		name:    "history_charged_energy_joules_total",
+		scale:   kilowattHoursToJoules,
+		counter: true,
+		help:    "Total energy charged in J",
+	},
+	"history_deepest_discharge": {
+		name:  "history_deepest_discharge_coulombs",
+		scale: ampereHoursToCoulombs,
+		help:  "Deepest discharge in C",
+	},
+	"history_discharge_energy_kwh": {
+		name:    "history_discharged_energy_joules_total",
+		scale:   kilowattHoursToJoules,
+		counter: true,
+		help:    "Total energy discharged in J",
+	},
+	"history_full_discharges": {
+		name:    "history_full_discharges_total",
+		counter: true,
+		help:    "Number of full discharges",
+	},
+	"history_high_starter_voltage_alarms": {
+		name:    "history_high_starter_voltage_alarms_total",
+		counter: true,
+		help:    "Number of high starter battery voltage alarms",
+	},
+	"history_high_voltage_alarms": {
+		name:    "history_high_voltage_alarms_total",
+		counter: true,
+		help:    "Number of high voltage alarms",
+	},
+	"history_last_discharge": {
+		name:  "history_last_discharge_coulombs",
+		scale: ampereHoursToCoulombs,
+		help:  "Last discharge in C",
+	},
+	"history_low_starter_voltage_alarms": {
+		name:    "history_low_starter_voltage_alarms_total",
+		counter: true,
+		help:    "Number of low starter battery voltage alarms",
+	},
+	"history_low_voltage_alarms": {
+		name:    "history_low_voltage_alarms_total",
+		counter: true,
+		help:    "Number of low voltage alarms",
+	},
+	"history_max_starter_voltage": {
+		name: "history_max_starter_voltage_volts",
+		help: "Maximum starter battery voltage in V",
+	},
+	"history_min_starter_voltage": {
+		name: "history_min_starter_voltage_volts",
+		help: "Minimum starter battery voltage in V",
+	},
+	"history_total_drawn_amphours": {
+		name:    "history_drawn_coulombs_total",
+		scale:   ampereHoursToCoulombs,
+		counter: true,
+		help:    "Total charge drawn in C",
+	},
+	"led_absoption": {
+		name: "led_absorption",
+		help: "0 = Off, 1 = On, 2 = Blinking, 3 = Blinking inverted",
+	},
+	"load_current_amps": {
+		name: "load_current_amperes",
+		help: "Current from the load output in A",
+	},
+	"max_charge_current_amps": {
+		name: "max_charge_current_amperes",
+		help: "Charge Current Limit aka CCL in A (BYD, Lynx BMS and FreedomWon)",
+	},
+	"max_discharge_current_amps": {
+		name: "max_discharge_current_amperes",
+		help: "Discharge Current Limit aka DCL in A (BYD, Lynx BMS and FreedomWon)",
+	},
+	"pv_array_current_amps": {
+		name: "pv_array_current_amperes",
+		help: "PV current in A (= /Yield/Power divided by /Pv/V)",
+	},
+	"settings_cgwacs_ac_power_set_point": {
+		name: "settings_cgwacs_ac_power_set_point_watts",
+		help: "User setting: Grid set-point in W",
+	},
+	"settings_cgwacs_battery_life_dischanged_time": {
+		name: "settings_cgwacs_battery_life_discharged_time",
+		help: "Internal",
+	},
+	"settings_cgwacs_battery_life_discharged_state_of_charge": {
+		name:  "settings_cgwacs_battery_life_discharged_state_of_charge_ratio",
+		scale: percentToRatio,
+		help:  "Deprecated",
+	},
+	"settings_cgwacs_battery_life_minimum_state_of_charge_limit": {
+		name:  "settings_cgwacs_battery_life_minimum_state_of_charge_limit_ratio",
+		scale: percentToRatio,
+		help:  "User setting: Minimum Discharge SOC, 0 to 1",
+	},
+	"settings_cgwacs_battery_life_state_of_charge_limit": {
+		name:  "settings_cgwacs_battery_life_state_of_charge_limit_ratio",
+		scale: percentToRatio,
+		help:  "Output of the BatteryLife algorithm, 0 to 1 (read only)",
+	},
+	"settings_cgwacs_max_charge_percentage": {
+		name:  "settings_cgwacs_max_charge_ratio",
+		scale: percentToRatio,
+		help:  "Deprecated",
+	},
+	"settings_cgwacs_max_discharge_percentage": {
+		name:  "settings_cgwacs_max_discharge_ratio",
+		scale: percentToRatio,
+		help:  "Deprecated",
+	},
+	"state_of_charge": {
+		name:  "state_of_charge_ratio",
+		scale: percentToRatio,
+		help:  "State of charge, 0 to 1 (BMV, BYD, Lynx BMS)",
+	},
+	"yield_system_total_kwh": {
+		name:    "yield_system_joules_total",
+		scale:   kilowattHoursToJoules,
+		counter: true,
+		help:    "Total energy produced in J (not resettable)",
+	},
+	"yield_user_total_kwh": {
+		name:    "yield_user_joules_total",
+		scale:   kilowattHoursToJoules,
+		counter: true,
+		help:    "Total energy produced in J (user resettable)",
+	},
+}
+
+func validateNaming(naming string) error {
+	switch naming {
+	case namingLegacy, namingPrometheus, namingBoth:
+		return nil
+	default:
+		return fmt.Errorf("unknown metric naming %q, expected legacy, prometheus or both", naming)
+	}
+}
+
+// reservedMetricName reports whether name, without the victron_ prefix, is
+// the new name of a renamed metric and so can't be used by a mapping.
+func reservedMetricName(name string) bool {
+	for _, r := range metricRenames {
+		if r.name == name {
+			return true
+		}
+	}
+
+	return false
+}
+
+// namingGatherer renames the metrics gathered from a Gatherer according
+// to the naming scheme.
+type namingGatherer struct {
+	gatherer prometheus.Gatherer
+	naming   string
+}
+
+func (g namingGatherer) Gather() ([]*dto.MetricFamily, error) {
+	mfs, err := g.gatherer.Gather()
+	if g.naming == namingLegacy {
+		return mfs, err
+	}
+
+	out := make([]*dto.MetricFamily, 0, len(mfs))
+	renamed := map[string]*dto.MetricFamily{}
+
+	for _, mf := range mfs {
+		r, ok := metricRenames[strings.TrimPrefix(mf.GetName(), namespace+"_")]
+		if !ok || !strings.HasPrefix(mf.GetName(), namespace+"_") {
+			out = append(out, mf)
+
+			continue
+		}
+
+		if g.naming == namingBoth {
+			out = append(out, mf)
+		}
+
+		// Several legacy metrics may be merged into one, for example
+		// ac_phase_current and ac_phase_current_amps
+		name := namespace + "_" + r.name
+
+		family, ok := renamed[name]
+		if !ok {
+			metricType := mf.GetType()
+			if r.counter {
+				metricType = dto.MetricType_COUNTER
+			}
+
+			help := r.help
+			family = &dto.MetricFamily{Name: &name, Help: &help, Type: &metricType}
+			renamed[name] = family
+			out = append(out, family)
+		}
+
+		for _, m := range mf.Metric {
+			family.Metric = append(family.Metric, r.convert(m))
+		}
+	}
+
+	sort.Slice(out, func(i, j int) bool { return out[i].GetName() < out[j].GetName() })
+
+	return out, err
+}
+
+func (r metricRename) convert(m *dto.Metric) *dto.Metric {
+	var v float64
+
+	switch {
+	case m.Gauge != nil:
+		v = m.Gauge.GetValue()
+	case m.Counter != nil:
+		v = m.Counter.GetValue()
+	default:
+		return m
+	}
+
+	if r.scale != 0 {
+		v *= r.scale
+	}
+
+	converted := &dto.Metric{Label: m.Label, TimestampMs: m.TimestampMs}
+	if r.counter || m.Counter != nil {
+		converted.Counter = &dto.Counter{Value: &v}
+	} else {
+		converted.Gauge = &dto.Gauge{Value: &v}
+	}
+
+	return converted
+}
+
+// metricsHandler serves the default registry's metrics, named according
+// to -metrics.naming and limited by any collect[] query parameters.
+func metricsHandler() http.Handler {
+	g := namingGatherer{gatherer: prometheus.DefaultGatherer, naming: *metricNaming}
+
+	return promhttp.InstrumentMetricHandler(prometheus.DefaultRegisterer,
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			serveCollected(g, w, r)
+		}))
+}
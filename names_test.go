@@ -0,0 +1,101 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+func TestMetricRenamesHelp(t *testing.T) {
+	for legacy, r := range metricRenames {
+		if r.help == "" {
+			t.Errorf("%s: no help text for %s", legacy, r.name)
+		}
+
+		if strings.Contains(r.help, "kWh") || strings.Contains(r.help, "Ah") || strings.Contains(r.help, "%") {
+			t.Errorf("%s: help text %q gives a legacy unit", legacy, r.help)
+		}
+	}
+}
+
+func TestNamingGatherer(t *testing.T) {
+	reg := prometheus.NewRegistry()
+
+	energy := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "yield_user_total_kwh",
+		Help:      "Total kWh produced (user resettable)",
+	}, []string{"site"})
+	energy.WithLabelValues("home").Set(2.5)
+	reg.MustRegister(energy)
+
+	voltage := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "dc_voltage_volts",
+		Help:      "V DC",
+	}, []string{"site"})
+	voltage.WithLabelValues("home").Set(52.1)
+	reg.MustRegister(voltage)
+
+	tests := []struct {
+		naming string
+		want   []string
+	}{
+		{namingLegacy, []string{"victron_dc_voltage_volts", "victron_yield_user_total_kwh"}},
+		{namingPrometheus, []string{"victron_dc_voltage_volts", "victron_yield_user_joules_total"}},
+		{namingBoth, []string{"victron_dc_voltage_volts", "victron_yield_user_joules_total", "victron_yield_user_total_kwh"}},
+	}
+
+	for _, tt := range tests {
+		mfs, err := namingGatherer{gatherer: reg, naming: tt.naming}.Gather()
+		if err != nil {
+			t.Fatalf("%s: Gather() error = %v", tt.naming, err)
+		}
+
+		var names []string
+		for _, mf := range mfs {
+			names = append(names, mf.GetName())
+		}
+
+		if strings.Join(names, ",") != strings.Join(tt.want, ",") {
+			t.Errorf("%s: gathered %v, want %v", tt.naming, names, tt.want)
+		}
+
+		for _, mf := range mfs {
+			if mf.GetName() != "victron_yield_user_joules_total" {
+				continue
+			}
+
+			if mf.GetType() != dto.MetricType_COUNTER {
+				t.Errorf("%s: %s is a %s, want a counter", tt.naming, mf.GetName(), mf.GetType())
+			}
+
+			if mf.GetHelp() != metricRenames["yield_user_total_kwh"].help {
+				t.Errorf("%s: %s help = %q, want the help in joules", tt.naming, mf.GetName(), mf.GetHelp())
+			}
+
+			if v := mf.Metric[0].GetCounter().GetValue(); v != 2.5*kilowattHoursToJoules {
+				t.Errorf("%s: %s = %g, want %g", tt.naming, mf.GetName(), v, 2.5*kilowattHoursToJoules)
+			}
+		}
+	}
+}
+
+// TestMetricRenamesComplete checks that built-in metrics named after a
+// quantity without a unit are renamed. Settings such as
+// settings_has_mid_voltage are flags rather than quantities.
+func TestMetricRenamesComplete(t *testing.T) {
+	for path, o := range suffixTopicMap {
+		if _, ok := metricRenames[o.name]; ok || strings.HasPrefix(o.name, "settings_has_") {
+			continue
+		}
+
+		for _, quantity := range []string{"_voltage", "_current", "_power", "_energy"} {
+			if strings.HasSuffix(o.name, quantity) {
+				t.Errorf("%s: %s has no unit and isn't renamed", path, o.name)
+			}
+		}
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// portalIDTracker holds the portal ID (VRM identifier) of the GX that
+// a site's subscription connection is talking to.
+type portalIDTracker struct {
+	site string
+	// pinned is the portal ID from the site configuration, if any.
+	// Messages from other portals are ignored when it is set.
+	pinned string
+
+	mu       sync.RWMutex
+	portalID string
+}
+
+func (p *portalIDTracker) get() string {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	return p.portalID
+}
+
+// accepts reports whether messages from portalID belong to this site.
+func (p *portalIDTracker) accepts(portalID string) bool {
+	return p.pinned == "" || p.pinned == portalID
+}
+
+// set records the portal ID announced on N/<portal id>/system/0/Serial
+// and reports whether it differs from the previously known ID.
+func (p *portalIDTracker) set(portalID string) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if portalID == "" || portalID == p.portalID || !p.accepts(portalID) {
+		return false
+	}
+
+	if p.portalID == "" {
+		log.WithFields(log.Fields{
+			"site":      p.site,
+			"portal_id": portalID,
+		}).Info("discovered portal ID")
+	} else {
+		log.WithFields(log.Fields{
+			"site":               p.site,
+			"portal_id":          portalID,
+			"previous_portal_id": p.portalID,
+		}).Warn("portal ID changed")
+		deletePortalMetrics(p.site, p.portalID)
+	}
+
+	portalInfo.WithLabelValues(p.site, portalID).Set(1)
+	p.portalID = portalID
+
+	return true
+}
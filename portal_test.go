@@ -0,0 +1,76 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// TestPortalChangeDeletesSeries checks that the series of the previous
+// portal are dropped when a site's portal ID changes.
+func TestPortalChangeDeletesSeries(t *testing.T) {
+	defer func(sample bool) { *sampleTimestamps = sample }(*sampleTimestamps)
+
+	*sampleTimestamps = true
+
+	s := newTestSite(t, "portal", "tcp://127.0.0.1:1")
+
+	send := func(portalID string, topic string, payload string) {
+		s.handleMessage(replayMessage{topic: "N/" + portalID + "/" + topic, payload: []byte(payload)}, time.Now())
+	}
+
+	send("c0619ab12345", "system/0/Serial", `{"value": "c0619ab12345"}`)
+	send("c0619ab12345", "battery/512/Soc", `{"value": 61.5}`)
+	send("c0619ab99999", "system/0/Serial", `{"value": "c0619ab99999"}`)
+	send("c0619ab99999", "battery/512/Soc", `{"value": 40}`)
+
+	series := func(portalID string) int {
+		count := 0
+
+		for _, c := range []prometheus.Collector{portalInfo, suffixTopicMap["Soc"].collector} {
+			ch := make(chan prometheus.Metric, 100)
+			c.Collect(ch)
+			close(ch)
+
+			for m := range ch {
+				labels := metricLabels(m)
+				if labels["site"] == "portal" && labels["portal_id"] == portalID {
+					count++
+				}
+			}
+		}
+
+		return count
+	}
+
+	if got := series("c0619ab12345"); got != 0 {
+		t.Errorf("%d series left for the previous portal, want 0", got)
+	}
+
+	if got := series("c0619ab99999"); got != 2 {
+		t.Errorf("%d series for the new portal, want 2", got)
+	}
+
+	if got := testutil.ToFloat64(portalInfo.WithLabelValues("portal", "c0619ab99999")); got != 1 {
+		t.Errorf("portal info = %g, want 1", got)
+	}
+}
+
+// metricLabels returns the labels of m.
+func metricLabels(m prometheus.Metric) map[string]string {
+	var pb dto.Metric
+
+	labels := map[string]string{}
+	if m.Write(&pb) != nil {
+		return labels
+	}
+
+	for _, l := range pb.Label {
+		labels[l.GetName()] = l.GetValue()
+	}
+
+	return labels
+}
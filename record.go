@@ -0,0 +1,219 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+)
+
+// recordedMessage is a line of a recording.
+type recordedMessage struct {
+	Timestamp time.Time `json:"timestamp"`
+	Site      string    `json:"site"`
+	Topic     string    `json:"topic"`
+	Payload   string    `json:"payload"`
+}
+
+// recorder writes every received message to a gzipped JSONL file.
+type recorder struct {
+	mu  sync.Mutex
+	f   *os.File
+	gz  *gzip.Writer
+	enc *json.Encoder
+}
+
+func newRecorder(path string) (*recorder, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create recording: %w", err)
+	}
+
+	gz := gzip.NewWriter(f)
+
+	return &recorder{f: f, gz: gz, enc: json.NewEncoder(gz)}, nil
+}
+
+func (r *recorder) record(siteName string, msg mqtt.Message, receivedAt time.Time) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	err := r.enc.Encode(recordedMessage{
+		Timestamp: receivedAt,
+		Site:      siteName,
+		Topic:     msg.Topic(),
+		Payload:   string(msg.Payload()),
+	})
+	if err != nil {
+		log.WithError(err).Warn("failed to record mqtt message")
+	}
+}
+
+// close flushes the recording and closes the file.
+func (r *recorder) close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	err := r.gz.Close()
+	if err != nil {
+		r.f.Close()
+
+		return err
+	}
+
+	return r.f.Close()
+}
+
+// replayMessage is a recorded message passed to a site.
+type replayMessage struct {
+	topic   string
+	payload []byte
+}
+
+func (m replayMessage) Duplicate() bool   { return false }
+func (m replayMessage) Qos() byte         { return 0 }
+func (m replayMessage) Retained() bool    { return false }
+func (m replayMessage) Topic() string     { return m.topic }
+func (m replayMessage) MessageID() uint16 { return 0 }
+func (m replayMessage) Payload() []byte   { return m.payload }
+func (m replayMessage) Ack()              {}
+
+// runReplay feeds a recording through a site per recorded site, without
+// connecting to a broker, and serves the resulting metrics until
+// interrupted.
+func runReplay(ctx context.Context, fs *flag.FlagSet, args []string) error {
+	speed := fs.Float64("speed", 1, "Replay speed relative to the recording. 0 replays as fast as possible")
+
+	err := fs.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	if fs.NArg() != 1 {
+		fs.Usage()
+
+		return errors.New("expected a recording")
+	}
+
+	setLogLevel(*logLevel)
+
+	if *lastUpdateTimestamps {
+		prometheus.MustRegister(lastUpdateTimestampSeconds)
+	}
+
+	listenAddr := *listenAddress
+
+	// Mappings from the config file apply, so that they can be tried
+	// out against a recording
+	if *configFile != "" {
+		c, err := loadConfiguration()
+		if err != nil {
+			return err
+		}
+
+		err = registerMappings(c.Mappings)
+		if err != nil {
+			return err
+		}
+
+		err = applyFilters(c.Filters)
+		if err != nil {
+			return err
+		}
+
+		listenAddr = c.HTTP.ListenAddress
+	}
+
+	f, err := os.Open(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		return fmt.Errorf("failed to read recording: %w", err)
+	}
+
+	http.Handle("/metrics", metricsHandler())
+	server := &http.Server{Addr: listenAddr, ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		err := server.ListenAndServe()
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.WithField("address", listenAddr).WithError(err).Fatal("failed to listen on address")
+		}
+	}()
+	defer server.Close()
+
+	log.WithField("address", listenAddr).Info("victron_exporter listening")
+
+	count, err := replay(ctx, gz, *speed)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(os.Stderr, "replayed %d messages, serving metrics on %s until interrupted\n", count, listenAddr)
+	<-ctx.Done()
+
+	return nil
+}
+
+// replay passes each recorded message to its site, as received at the
+// recorded time, waiting between messages as long as the recording did,
+// divided by speed.
+func replay(ctx context.Context, r io.Reader, speed float64) (int, error) {
+	sites := map[string]*site{}
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+
+	var (
+		previous time.Time
+		count    int
+	)
+
+	for scanner.Scan() {
+		var m recordedMessage
+
+		err := json.Unmarshal(scanner.Bytes(), &m)
+		if err != nil {
+			return count, fmt.Errorf("line %d: %w", count+1, err)
+		}
+
+		if speed > 0 && !previous.IsZero() && m.Timestamp.After(previous) {
+			select {
+			case <-time.After(time.Duration(float64(m.Timestamp.Sub(previous)) / speed)):
+			case <-ctx.Done():
+				return count, nil
+			}
+		}
+
+		previous = m.Timestamp
+
+		s, ok := sites[m.Site]
+		if !ok {
+			s, err = newSite(siteConfig{Name: m.Site}, siteOptions{keepaliveMode: keepaliveModeAuto})
+			if err != nil {
+				return count, err
+			}
+
+			sites[m.Site] = s
+		}
+
+		s.handleMessage(replayMessage{topic: m.Topic, payload: []byte(m.Payload)}, m.Timestamp)
+		count++
+	}
+
+	return count, scanner.Err()
+}
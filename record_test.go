@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+func TestReplayUsesRecordedTimestamps(t *testing.T) {
+	defer func(last bool, sample bool) {
+		*lastUpdateTimestamps, *sampleTimestamps = last, sample
+	}(*lastUpdateTimestamps, *sampleTimestamps)
+
+	*lastUpdateTimestamps, *sampleTimestamps = true, true
+
+	defer deleteSiteMetrics("replay")
+
+	recording := strings.Join([]string{
+		`{"timestamp": "2022-06-21T12:00:00Z", "site": "replay", "topic": "N/c0619ab12345/system/0/Serial", "payload": "{\"value\": \"c0619ab12345\"}"}`,
+		`{"timestamp": "2022-06-21T12:00:05Z", "site": "replay", "topic": "N/c0619ab12345/battery/512/Soc", "payload": "{\"value\": 61.5}"}`,
+	}, "\n")
+
+	count, err := replay(context.Background(), strings.NewReader(recording), 0)
+	if err != nil || count != 2 {
+		t.Fatalf("replay() = %d, %v, want 2 messages", count, err)
+	}
+
+	recorded := time.Date(2022, 6, 21, 12, 0, 5, 0, time.UTC)
+
+	var m dto.Metric
+
+	err = lastUpdateTimestampSeconds.WithLabelValues("replay", "c0619ab12345", "battery", "512", "Soc").Write(&m)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := m.GetGauge().GetValue(); got != float64(recorded.Unix()) {
+		t.Errorf("last update timestamp = %g, want %d", got, recorded.Unix())
+	}
+
+	ch := make(chan prometheus.Metric, 100)
+	suffixTopicMap["Soc"].collector.Collect(ch)
+	close(ch)
+
+	found := false
+
+	for metric := range ch {
+		var pb dto.Metric
+		if metric.Write(&pb) != nil {
+			continue
+		}
+
+		for _, l := range pb.Label {
+			if l.GetName() != "site" || l.GetValue() != "replay" {
+				continue
+			}
+
+			found = true
+
+			if pb.GetTimestampMs() != recorded.UnixNano()/1e6 {
+				t.Errorf("sample timestamp = %d, want %d", pb.GetTimestampMs(), recorded.UnixNano()/1e6)
+			}
+		}
+	}
+
+	if !found {
+		t.Error("replayed state of charge not exported")
+	}
+}
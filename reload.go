@@ -0,0 +1,306 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// supervisedSite is a running site and the configuration it was built from.
+type supervisedSite struct {
+	site   *site
+	config siteConfig
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// failed reports whether the site has stopped without being asked to.
+func (r *supervisedSite) failed() bool {
+	select {
+	case <-r.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// siteSupervisor runs the configured sites and applies configuration
+// changes, restarting only the sites whose configuration changed.
+type siteSupervisor struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+	opts   siteOptions
+	wg     sync.WaitGroup
+
+	mu      sync.Mutex
+	running map[string]*supervisedSite
+	// started is set once the initial sites have been started. Sites
+	// that fail to connect before then stop the exporter; sites added
+	// by a reload only log the failure.
+	started bool
+
+	// failed is set when an initial site fails, accessed atomically
+	failed int32
+}
+
+func newSiteSupervisor(ctx context.Context, opts siteOptions) *siteSupervisor {
+	ctx, cancel := context.WithCancel(ctx)
+
+	return &siteSupervisor{
+		ctx:     ctx,
+		cancel:  cancel,
+		opts:    opts,
+		running: map[string]*supervisedSite{},
+	}
+}
+
+// apply brings the running sites in line with configs. Sites are only
+// stopped once every new or changed site has been built, so an invalid
+// configuration leaves the running sites untouched.
+func (sv *siteSupervisor) apply(configs []siteConfig) error {
+	sv.mu.Lock()
+	defer sv.mu.Unlock()
+
+	if sv.ctx.Err() != nil {
+		return sv.ctx.Err()
+	}
+
+	wanted := map[string]bool{}
+
+	var added []*supervisedSite
+
+	for _, sc := range configs {
+		wanted[sc.Name] = true
+
+		// Sites that failed to connect are restarted even if unchanged
+		if r, ok := sv.running[sc.Name]; ok && !r.failed() && reflect.DeepEqual(r.config, sc) {
+			continue
+		}
+
+		s, err := newSite(sc, sv.opts)
+		if err != nil {
+			return fmt.Errorf("site %q: %w", sc.Name, err)
+		}
+
+		added = append(added, &supervisedSite{site: s, config: sc})
+	}
+
+	for name, r := range sv.running {
+		if wanted[name] {
+			continue
+		}
+
+		r.site.logger().Info("site removed from configuration")
+		sv.stop(r)
+	}
+
+	for _, a := range added {
+		if r, ok := sv.running[a.site.name]; ok {
+			r.site.logger().Info("site configuration changed, reconnecting")
+			sv.stop(r)
+		}
+
+		sv.start(a)
+	}
+
+	sv.started = true
+
+	return nil
+}
+
+func (sv *siteSupervisor) start(r *supervisedSite) {
+	ctx, cancel := context.WithCancel(sv.ctx)
+	r.cancel = cancel
+	r.done = make(chan struct{})
+	sv.running[r.site.name] = r
+	initial := !sv.started
+
+	sv.wg.Add(1)
+
+	go func() {
+		defer sv.wg.Done()
+		defer close(r.done)
+
+		err := r.site.run(ctx)
+		if err == nil {
+			return
+		}
+
+		r.site.logger().WithError(err).Error("site failed")
+
+		if initial {
+			atomic.StoreInt32(&sv.failed, 1)
+			sv.cancel()
+		}
+	}()
+}
+
+// stop stops a running site and removes its metrics.
+func (sv *siteSupervisor) stop(r *supervisedSite) {
+	r.cancel()
+	<-r.done
+
+	delete(sv.running, r.site.name)
+	deleteSiteMetrics(r.site.name)
+	connections.deleteSite(r.site.name)
+}
+
+// sites returns the running sites, sorted by name.
+func (sv *siteSupervisor) sites() []*site {
+	sv.mu.Lock()
+	defer sv.mu.Unlock()
+
+	sites := make([]*site, 0, len(sv.running))
+	for _, r := range sv.running {
+		sites = append(sites, r.site)
+	}
+
+	sort.Slice(sites, func(i, j int) bool { return sites[i].name < sites[j].name })
+
+	return sites
+}
+
+// wait blocks until ctx is done or one of the initial sites fails to
+// start, and every site has stopped. It reports whether a site failed.
+func (sv *siteSupervisor) wait() bool {
+	<-sv.ctx.Done()
+	sv.wg.Wait()
+
+	return atomic.LoadInt32(&sv.failed) == 1
+}
+
+// configReloader reloads the configuration file on SIGHUP, and whenever
+// its contents or the secret files it names change when polling is
+// enabled.
+type configReloader struct {
+	path       string
+	interval   time.Duration
+	load       func() (*config, error)
+	supervisor *siteSupervisor
+	// initial is the configuration the exporter started with
+	initial *config
+	// secrets are the secret files named by the last configuration loaded
+	secrets  []string
+	contents []byte
+}
+
+func (r *configReloader) run(ctx context.Context) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	r.secrets = r.initial.secretFiles()
+	r.contents, _ = r.read()
+
+	var poll <-chan time.Time
+
+	if r.interval > 0 {
+		ticker := time.NewTicker(r.interval)
+		defer ticker.Stop()
+
+		poll = ticker.C
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+			log.WithField("file", r.path).Info("reloading configuration")
+		case <-poll:
+			b, err := r.read()
+			if err != nil || bytes.Equal(b, r.contents) {
+				continue
+			}
+
+			log.WithField("file", r.path).Info("configuration file changed, reloading")
+		}
+
+		r.reload()
+	}
+}
+
+func (r *configReloader) reload() {
+	// Record the contents even if they are invalid, so that polling
+	// doesn't log the same error until the file changes again
+	r.contents, _ = r.read()
+
+	c, err := r.load()
+	if err != nil {
+		log.WithError(err).Error("failed to reload configuration, keeping the current configuration")
+
+		return
+	}
+
+	r.secrets = c.secretFiles()
+	r.contents, _ = r.read()
+
+	// Only sites can be changed while running, so a configuration that
+	// changes anything else is rejected rather than partly applied
+	changed := restartRequired(r.initial, c)
+	if len(changed) > 0 {
+		log.WithError(fmt.Errorf("changes to %s need a restart", strings.Join(changed, ", "))).
+			Error("failed to reload configuration, keeping the current configuration")
+
+		return
+	}
+
+	err = r.supervisor.apply(c.Sites)
+	if err != nil {
+		log.WithError(err).Error("failed to apply configuration, keeping the current sites")
+	}
+}
+
+// read returns the contents of the configuration file followed by those
+// of the secret files, so that a rotated password or access token is
+// picked up by polling too. Secret files that can't be read are left out,
+// and reported when the configuration is loaded.
+func (r *configReloader) read() ([]byte, error) {
+	b, err := os.ReadFile(r.path)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, path := range r.secrets {
+		secret, err := os.ReadFile(path)
+		if err != nil {
+			continue
+		}
+
+		b = append(append(append(b, 0), path...), 0)
+		b = append(b, secret...)
+	}
+
+	return b, nil
+}
+
+// restartRequired returns the sections of the configuration, other than
+// sites, that differ between the running configuration and c.
+func restartRequired(running *config, c *config) []string {
+	var changed []string
+
+	if !reflect.DeepEqual(c.HTTP, running.HTTP) {
+		changed = append(changed, "http")
+	}
+
+	if !reflect.DeepEqual(c.Mappings, running.Mappings) {
+		changed = append(changed, "mappings")
+	}
+
+	if !reflect.DeepEqual(c.Filters, running.Filters) {
+		changed = append(changed, "filters")
+	}
+
+	return changed
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestRestartRequired(t *testing.T) {
+	running := &config{
+		HTTP:     httpConfig{ListenAddress: ":9226"},
+		Sites:    []siteConfig{{Name: "boat"}},
+		Mappings: []mappingConfig{{Path: "Test/Path", Name: "test_path"}},
+		Filters:  filtersConfig{Exclude: []filterRule{{Metric: "led_.*"}}},
+	}
+
+	tests := []struct {
+		name   string
+		change func(c *config)
+		want   string
+	}{
+		{"unchanged", func(c *config) {}, ""},
+		{"sites", func(c *config) { c.Sites = append(c.Sites, siteConfig{Name: "home"}) }, ""},
+		{"http", func(c *config) { c.HTTP.ListenAddress = ":9227" }, "http"},
+		{"mappings", func(c *config) { c.Mappings = nil }, "mappings"},
+		{"filters", func(c *config) { c.Filters.Exclude[0].Metric = "led" }, "filters"},
+		{"several", func(c *config) { c.HTTP.ReadyMaxDataAge = time.Minute; c.Filters = filtersConfig{} }, "http,filters"},
+	}
+
+	for _, tt := range tests {
+		c := &config{
+			HTTP:     running.HTTP,
+			Sites:    append([]siteConfig{}, running.Sites...),
+			Mappings: append([]mappingConfig{}, running.Mappings...),
+			Filters:  filtersConfig{Exclude: append([]filterRule{}, running.Filters.Exclude...)},
+		}
+		tt.change(c)
+
+		if got := strings.Join(restartRequired(running, c), ","); got != tt.want {
+			t.Errorf("%s: restartRequired() = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+// hasSiteSeries reports whether any series is exported for the site.
+func hasSiteSeries(t *testing.T, name string) bool {
+	t.Helper()
+
+	mfs, err := prometheus.DefaultGatherer.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, mf := range mfs {
+		for _, m := range mf.Metric {
+			for _, l := range m.Label {
+				if l.GetName() == "site" && l.GetValue() == name {
+					return true
+				}
+			}
+		}
+	}
+
+	return false
+}
+
+func TestSiteSupervisorApply(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	sim := newSimulator("c0619ab12345", time.Now(), 1)
+	url := startTestBroker(t, sim.server)
+
+	go sim.run(ctx)
+
+	sv := newSiteSupervisor(ctx, testSiteOptions)
+	defer func() {
+		cancel()
+		sv.wait()
+	}()
+
+	kept := siteConfig{Name: "reload-kept", brokerSettings: brokerSettings{URL: url}}
+	removed := siteConfig{Name: "reload-removed", brokerSettings: brokerSettings{URL: url}}
+	// Nothing listens on port 1, so this site fails to connect
+	failing := siteConfig{Name: "reload-failing", brokerSettings: brokerSettings{URL: "tcp://127.0.0.1:1"}}
+
+	err := sv.apply([]siteConfig{kept, removed})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !waitFor(func() bool { return hasSiteSeries(t, removed.Name) }) {
+		t.Fatal("no series exported for the site to be removed")
+	}
+
+	err = sv.apply([]siteConfig{kept, failing})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sv.mu.Lock()
+	first, failed := sv.running[kept.Name], sv.running[failing.Name]
+	_, stillRunning := sv.running[removed.Name]
+	sv.mu.Unlock()
+
+	if stillRunning {
+		t.Error("removed site still running")
+	}
+
+	if hasSiteSeries(t, removed.Name) {
+		t.Error("removed site's series still exported")
+	}
+
+	if !waitFor(failed.failed) {
+		t.Fatal("site with an unreachable broker did not fail")
+	}
+
+	err = sv.apply([]siteConfig{kept, failing})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sv.mu.Lock()
+	defer sv.mu.Unlock()
+
+	if sv.running[kept.Name] != first {
+		t.Error("unchanged site restarted")
+	}
+
+	if sv.running[failing.Name] == failed {
+		t.Error("failed site not restarted")
+	}
+}
+
+// TestConfigReloaderSecretRotation checks that polling picks up a changed
+// password file.
+func TestConfigReloaderSecretRotation(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	sim := newSimulator("c0619ab12345", time.Now(), 1)
+	url := startTestBroker(t, sim.server)
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, "config.yaml")
+	secret := filepath.Join(dir, "password")
+
+	write := func(path string, contents string) {
+		err := os.WriteFile(path, []byte(contents), 0o600)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	write(secret, "first\n")
+	write(path, "sites:\n  - name: reload-secret\n    url: "+url+"\n    username: me\n    password_file: "+secret+"\n")
+
+	load := func() (*config, error) { return loadConfig(path, siteConfig{}, httpConfig{}) }
+
+	c, err := load()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sv := newSiteSupervisor(ctx, testSiteOptions)
+	defer func() {
+		cancel()
+		sv.wait()
+		deleteSiteMetrics("reload-secret")
+	}()
+
+	err = sv.apply(c.Sites)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := &configReloader{path: path, interval: 20 * time.Millisecond, load: load, supervisor: sv, initial: c}
+	go r.run(ctx)
+
+	password := func() string {
+		sv.mu.Lock()
+		defer sv.mu.Unlock()
+
+		return sv.running["reload-secret"].config.Password
+	}
+
+	// Let the reloader read the files before the secret is rotated
+	time.Sleep(100 * time.Millisecond)
+	write(secret, "second\n")
+
+	if !waitFor(func() bool { return password() == "second" }) {
+		t.Errorf("password = %q after rotating the password file, want %q", password(), "second")
+	}
+}
@@ -0,0 +1,555 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"math"
+	"math/rand"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// simulatorKeepaliveTimeout is how long the simulator keeps publishing
+	// after a keepalive, as dbus-flashmq does
+	simulatorKeepaliveTimeout = time.Minute
+
+	simulatorBatteryCapacityWh = 10000
+	simulatorMaxBatteryPower   = 3000
+	simulatorSolarPeakPower    = 4000
+)
+
+// simulator publishes the topic tree of a Venus GX with a grid-connected
+// ESS system, with solar, load and state of charge following the time of
+// day. It answers keepalives, reads and writes like dbus-flashmq.
+type simulator struct {
+	portalID string
+	server   *mqttServer
+	rand     *rand.Rand
+
+	mu sync.Mutex
+	// now is the simulated time, which runs speed times faster than real
+	// time
+	now   time.Time
+	speed float64
+	// values holds the current value of each path, keyed by service,
+	// instance and path
+	values map[string]interface{}
+	// published holds the values last published, so that only changes
+	// are published between full publishes
+	published      map[string]interface{}
+	keepaliveUntil time.Time
+	// soc is kept apart from values so that it isn't rounded
+	soc        float64
+	cloudiness float64
+}
+
+// simulated device instances
+const (
+	simulatorVebus        = "vebus/276"
+	simulatorBattery      = "battery/512"
+	simulatorSolarcharger = "solarcharger/279"
+	simulatorGrid         = "grid/30"
+)
+
+func newSimulator(portalID string, start time.Time, speed float64) *simulator {
+	sim := &simulator{
+		portalID: portalID,
+		rand:     rand.New(rand.NewSource(time.Now().UnixNano())),
+		now:      start,
+		speed:    speed,
+		values: map[string]interface{}{
+			"system/0/Serial":                                    portalID,
+			"system/0/Ac/ActiveIn/Source":                        1.0,
+			"system/0/Ac/Consumption/NumberOfPhases":             1.0,
+			"system/0/Ac/Grid/NumberOfPhases":                    1.0,
+			"system/0/Relay/0/State":                             0.0,
+			"system/0/SystemState/State":                         9.0,
+			"settings/0/Settings/CGwacs/AcPowerSetPoint":         50.0,
+			"settings/0/Settings/CGwacs/BatteryLife/SocLimit":    10.0,
+			"settings/0/Settings/CGwacs/Hub4Mode":                1.0,
+			"settings/0/Settings/CGwacs/MaxChargePower":          -1.0,
+			"settings/0/Settings/CGwacs/MaxDischargePower":       -1.0,
+			simulatorVebus + "/Mode":                             3.0,
+			simulatorVebus + "/ModeIsAdjustable":                 1.0,
+			simulatorVebus + "/Ac/In/1/CurrentLimit":             16.0,
+			simulatorVebus + "/Ac/In/1/CurrentLimitIsAdjustable": 1.0,
+			simulatorVebus + "/Ac/ActiveIn/Connected":            1.0,
+			simulatorVebus + "/Ac/ActiveIn/ActiveInput":          0.0,
+			simulatorBattery + "/Dc/0/Temperature":               22.0,
+			simulatorBattery + "/ConsumedAmphours":               0.0,
+			simulatorBattery + "/History/ChargedEnergy":          0.0,
+			simulatorBattery + "/History/DischargedEnergy":       0.0,
+			simulatorSolarcharger + "/ErrorCode":                 0.0,
+			simulatorSolarcharger + "/Yield/User":                0.0,
+			simulatorSolarcharger + "/Yield/System":              0.0,
+			simulatorGrid + "/Ac/Energy/Forward":                 0.0,
+			simulatorGrid + "/Ac/Energy/Reverse":                 0.0,
+			simulatorGrid + "/Ac/L1/Energy/Forward":              0.0,
+			simulatorGrid + "/Ac/L1/Energy/Reverse":              0.0,
+		},
+		published:  map[string]interface{}{},
+		soc:        60,
+		cloudiness: 0.2,
+	}
+
+	// Product details, which aren't mapped to metrics
+	for device, product := range map[string]string{
+		simulatorVebus:        "MultiPlus-II 48/5000/70-50",
+		simulatorBattery:      "SmartShunt 500A/50mV",
+		simulatorSolarcharger: "SmartSolar Charger MPPT 150/45",
+		simulatorGrid:         "Energy Meter ET112",
+	} {
+		sim.values[device+"/ProductName"] = product
+		sim.values[device+"/DeviceInstance"] = float64(deviceInstance(device))
+		sim.values[device+"/Connected"] = 1.0
+	}
+
+	sim.server = newMQTTServer(sim.handlePublish)
+	sim.step(0)
+
+	return sim
+}
+
+// deviceInstance returns the instance of a service/instance key.
+func deviceInstance(device string) int {
+	var instance int
+
+	_, _ = fmt.Sscanf(device[strings.Index(device, "/")+1:], "%d", &instance)
+
+	return instance
+}
+
+// run advances the simulation every second, publishing the values that
+// changed while a client is sending keepalives, until ctx is done.
+func (sim *simulator) run(ctx context.Context) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	sim.publish("system/0/Serial", sim.portalID, true)
+
+	last := time.Now()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			sim.step(time.Duration(float64(now.Sub(last)) * sim.speed))
+			last = now
+
+			if sim.alive(now) {
+				sim.publishChanged()
+				sim.publish("heartbeat", now.Unix(), false)
+			}
+		}
+	}
+}
+
+func (sim *simulator) alive(now time.Time) bool {
+	sim.mu.Lock()
+	defer sim.mu.Unlock()
+
+	return now.Before(sim.keepaliveUntil)
+}
+
+// step advances the simulated system by dt.
+func (sim *simulator) step(dt time.Duration) {
+	sim.mu.Lock()
+	defer sim.mu.Unlock()
+
+	sim.now = sim.now.Add(dt)
+	hours := dt.Hours()
+	hour := float64(sim.now.Hour()) + float64(sim.now.Minute())/60
+
+	// Clouds drift slowly between clear and overcast
+	sim.cloudiness = math.Min(0.9, math.Max(0, sim.cloudiness+sim.rand.NormFloat64()*0.02*math.Sqrt(dt.Minutes()+0.01)))
+
+	daylight := math.Max(0, math.Sin(math.Pi*(hour-6)/12))
+	pv := simulatorSolarPeakPower * daylight * (1 - sim.cloudiness)
+
+	// Base load with morning and evening peaks and some noise
+	load := 250 + 400*math.Exp(-math.Pow(hour-7.5, 2)/2) + 900*math.Exp(-math.Pow(hour-19, 2)/3) + sim.rand.NormFloat64()*40
+	load = math.Max(50, load)
+
+	soc := sim.soc
+	setpoint := sim.number("settings/0/Settings/CGwacs/AcPowerSetPoint")
+	minSoc := sim.number("settings/0/Settings/CGwacs/BatteryLife/SocLimit")
+	mode := sim.number(simulatorVebus + "/Mode")
+
+	// ESS: the battery makes up the difference so that the grid meter
+	// reads the setpoint
+	battery := pv + setpoint - load
+
+	switch mode {
+	case 1:
+		// Charger only: the inverter doesn't discharge the battery
+		battery = math.Max(0, battery)
+	case 4:
+		// Off: only the solar charger charges the battery
+		battery = pv
+	}
+
+	battery = math.Max(-simulatorMaxBatteryPower, math.Min(simulatorMaxBatteryPower, battery))
+
+	if (soc >= 100 && battery > 0) || (soc <= minSoc && battery < 0) {
+		battery = 0
+	}
+
+	grid := load - pv + battery
+	if mode == 4 {
+		grid = load
+	}
+
+	soc = math.Max(0, math.Min(100, soc+battery*hours/simulatorBatteryCapacityWh*100))
+	sim.soc = soc
+	voltage := 48 + soc*0.065 + battery*0.0002
+	current := battery / voltage
+
+	batteryState := 0.0
+
+	switch {
+	case battery > 10:
+		batteryState = 1
+	case battery < -10:
+		batteryState = 2
+	}
+
+	timeToGo := interface{}(nil)
+	if battery < -10 {
+		timeToGo = math.Round((soc - minSoc) / 100 * simulatorBatteryCapacityWh / -battery * 3600)
+	}
+
+	pvVoltage := 0.0
+	if pv > 0 {
+		pvVoltage = 120 + 20*daylight
+	}
+
+	pvCurrent := 0.0
+	if pvVoltage > 0 {
+		pvCurrent = pv / pvVoltage
+	}
+
+	solarState := 0.0
+	if pv > 0 {
+		solarState = 3
+		if soc >= 100 {
+			solarState = 5
+		}
+	}
+
+	vebusState := 9.0
+	if battery > 10 {
+		vebusState = 3
+	}
+
+	if mode == 4 {
+		vebusState = 0
+	}
+
+	acVoltage := 230 + sim.rand.NormFloat64()
+	frequency := 50 + sim.rand.NormFloat64()*0.02
+
+	sim.set("system/0/Dc/Battery/Soc", soc)
+	sim.set("system/0/Dc/Battery/Voltage", voltage)
+	sim.set("system/0/Dc/Battery/Current", current)
+	sim.set("system/0/Dc/Battery/Power", battery)
+	sim.set("system/0/Dc/Battery/State", batteryState)
+	sim.set("system/0/Dc/Battery/TimeToGo", timeToGo)
+	sim.set("system/0/Dc/Pv/Power", pv)
+	sim.set("system/0/Dc/Pv/Current", pv/voltage)
+	sim.set("system/0/Dc/Vebus/Power", battery-pv)
+	sim.set("system/0/Ac/Consumption/L1/Power", load)
+	sim.set("system/0/Ac/Grid/L1/Power", grid)
+
+	sim.set(simulatorVebus+"/Dc/0/Voltage", voltage)
+	sim.set(simulatorVebus+"/Dc/0/Current", (battery-pv)/voltage)
+	sim.set(simulatorVebus+"/Dc/0/Power", battery-pv)
+	sim.set(simulatorVebus+"/Ac/ActiveIn/L1/V", acVoltage)
+	sim.set(simulatorVebus+"/Ac/ActiveIn/L1/F", frequency)
+	sim.set(simulatorVebus+"/Ac/ActiveIn/L1/P", grid)
+	sim.set(simulatorVebus+"/Ac/ActiveIn/L1/I", grid/acVoltage)
+	sim.set(simulatorVebus+"/Ac/ActiveIn/P", grid)
+	sim.set(simulatorVebus+"/Ac/Out/L1/V", acVoltage)
+	sim.set(simulatorVebus+"/Ac/Out/L1/F", frequency)
+	sim.set(simulatorVebus+"/Ac/Out/L1/P", load)
+	sim.set(simulatorVebus+"/Ac/Out/L1/I", load/acVoltage)
+	sim.set(simulatorVebus+"/Ac/Out/P", load)
+	sim.set(simulatorVebus+"/State", vebusState)
+	sim.set(simulatorVebus+"/Ac/PowerMeasurementType", 4.0)
+
+	sim.set(simulatorBattery+"/Soc", soc)
+	sim.set(simulatorBattery+"/Dc/0/Voltage", voltage)
+	sim.set(simulatorBattery+"/Dc/0/Current", current)
+	sim.set(simulatorBattery+"/Dc/0/Power", battery)
+	sim.set(simulatorBattery+"/TimeToGo", timeToGo)
+	sim.set(simulatorBattery+"/ConsumedAmphours", -(100-soc)/100*simulatorBatteryCapacityWh/voltage)
+	sim.add(simulatorBattery+"/History/ChargedEnergy", math.Max(0, battery)*hours/1000)
+	sim.add(simulatorBattery+"/History/DischargedEnergy", math.Max(0, -battery)*hours/1000)
+
+	sim.set(simulatorSolarcharger+"/Pv/V", pvVoltage)
+	sim.set(simulatorSolarcharger+"/Pv/I", pvCurrent)
+	sim.set(simulatorSolarcharger+"/Yield/Power", pv)
+	sim.set(simulatorSolarcharger+"/Dc/0/Voltage", voltage)
+	sim.set(simulatorSolarcharger+"/Dc/0/Current", pv/voltage)
+	sim.set(simulatorSolarcharger+"/State", solarState)
+	sim.add(simulatorSolarcharger+"/Yield/User", pv*hours/1000)
+	sim.add(simulatorSolarcharger+"/Yield/System", pv*hours/1000)
+
+	sim.set(simulatorGrid+"/Ac/Power", grid)
+	sim.set(simulatorGrid+"/Ac/L1/Power", grid)
+	sim.set(simulatorGrid+"/Ac/L1/Voltage", acVoltage)
+	sim.set(simulatorGrid+"/Ac/L1/Current", grid/acVoltage)
+	sim.add(simulatorGrid+"/Ac/Energy/Forward", math.Max(0, grid)*hours/1000)
+	sim.add(simulatorGrid+"/Ac/Energy/Reverse", math.Max(0, -grid)*hours/1000)
+	sim.add(simulatorGrid+"/Ac/L1/Energy/Forward", math.Max(0, grid)*hours/1000)
+	sim.add(simulatorGrid+"/Ac/L1/Energy/Reverse", math.Max(0, -grid)*hours/1000)
+}
+
+// number returns a numeric value, or 0 if it isn't set. sim.mu must be
+// held.
+func (sim *simulator) number(key string) float64 {
+	v, _ := sim.values[key].(float64)
+
+	return v
+}
+
+// set sets a value, rounded as the GX would round it. sim.mu must be held.
+func (sim *simulator) set(key string, value interface{}) {
+	if v, ok := value.(float64); ok {
+		value = math.Round(v*100) / 100
+	}
+
+	sim.values[key] = value
+}
+
+// add adds to a running total. sim.mu must be held.
+func (sim *simulator) add(key string, delta float64) {
+	sim.values[key] = sim.number(key) + delta
+}
+
+// handlePublish answers keepalives, reads and writes from clients.
+func (sim *simulator) handlePublish(topic string, payload []byte) {
+	parts := strings.SplitN(topic, "/", 3)
+	if len(parts) < 3 || parts[1] != sim.portalID {
+		return
+	}
+
+	switch {
+	case parts[0] == "R" && parts[2] == "keepalive":
+		sim.keepalive(payload)
+	case parts[0] == "R" && parts[2] == "system/0/Serial":
+		sim.legacyKeepalive()
+	case parts[0] == "R":
+		sim.read(parts[2])
+	case parts[0] == "W":
+		sim.write(parts[2], payload)
+	}
+}
+
+func (sim *simulator) keepalive(payload []byte) {
+	var request struct {
+		Options []string `json:"keepalive-options"`
+	}
+
+	_ = json.Unmarshal(payload, &request)
+
+	sim.mu.Lock()
+	sim.keepaliveUntil = time.Now().Add(simulatorKeepaliveTimeout)
+	sim.mu.Unlock()
+
+	for _, option := range request.Options {
+		if option == "suppress-republish" {
+			return
+		}
+	}
+
+	sim.publishAll()
+	sim.publish("full_publish_completed", time.Now().Unix(), false)
+}
+
+// legacyKeepalive answers a read of the serial number, which older
+// firmware treats as a keepalive. Like dbus-mqtt, everything is published
+// when a keepalive arrives after publishing had stopped.
+func (sim *simulator) legacyKeepalive() {
+	now := time.Now()
+
+	sim.mu.Lock()
+	stopped := !now.Before(sim.keepaliveUntil)
+	sim.keepaliveUntil = now.Add(simulatorKeepaliveTimeout)
+	sim.mu.Unlock()
+
+	if stopped {
+		sim.publishAll()
+	} else {
+		sim.read("system/0/Serial")
+	}
+}
+
+func (sim *simulator) read(key string) {
+	sim.mu.Lock()
+	value, ok := sim.values[key]
+	sim.mu.Unlock()
+
+	if ok {
+		sim.publish(key, value, false)
+	}
+}
+
+// write changes a value that the write API allows, publishing the new
+// value if it changed, as the GX does. Other writes are ignored.
+func (sim *simulator) write(key string, payload []byte) {
+	logger := log.WithField("path", key)
+
+	parts := strings.SplitN(key, "/", 3)
+	if len(parts) < 3 {
+		return
+	}
+
+	allowed, ok := writablePaths[parts[0]+"/"+parts[2]]
+	if !ok {
+		logger.Warn("ignoring write to read-only path")
+
+		return
+	}
+
+	var v victronValue
+
+	err := json.Unmarshal(payload, &v)
+	if err != nil || v.Value == nil {
+		logger.Warn("ignoring write with invalid payload")
+
+		return
+	}
+
+	err = allowed.validate(*v.Value)
+	if err != nil {
+		logger.WithError(err).Warn("ignoring write")
+
+		return
+	}
+
+	sim.mu.Lock()
+	previous, exists := sim.values[key]
+	if exists {
+		sim.values[key] = *v.Value
+		sim.published[key] = *v.Value
+	}
+	sim.mu.Unlock()
+
+	if !exists {
+		logger.Warn("ignoring write to unknown path")
+
+		return
+	}
+
+	logger.WithField("value", *v.Value).Info("simulated write")
+
+	// Like the GX, only a change is published
+	if previous != *v.Value {
+		sim.publish(key, *v.Value, false)
+	}
+}
+
+func (sim *simulator) publishAll() {
+	sim.publishValues(true)
+}
+
+// publishChanged publishes the values that changed since they were last
+// published, as the GX does between full publishes.
+func (sim *simulator) publishChanged() {
+	sim.publishValues(false)
+}
+
+func (sim *simulator) publishValues(all bool) {
+	sim.mu.Lock()
+	keys := make([]string, 0, len(sim.values))
+	values := make(map[string]interface{}, len(sim.values))
+
+	for k, v := range sim.values {
+		if !all {
+			if published, ok := sim.published[k]; ok && published == v {
+				continue
+			}
+		}
+
+		keys = append(keys, k)
+		values[k] = v
+		sim.published[k] = v
+	}
+	sim.mu.Unlock()
+
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		sim.publish(k, values[k], false)
+	}
+}
+
+// publish publishes a value to N/<portal ID>/<key>, where key is a
+// service, instance and path or a topic such as heartbeat.
+func (sim *simulator) publish(key string, value interface{}, retain bool) {
+	payload, err := json.Marshal(map[string]interface{}{"value": value})
+	if err != nil {
+		log.WithError(err).WithField("path", key).Error("failed to encode simulated value")
+
+		return
+	}
+
+	sim.server.publish("N/"+sim.portalID+"/"+key, payload, retain)
+}
+
+// runSimulate runs the simulator until interrupted.
+func runSimulate(ctx context.Context, fs *flag.FlagSet, args []string) error {
+	listen := fs.String("listen", "127.0.0.1:1883", "Address on which the simulated GX accepts MQTT connections")
+	portalID := fs.String("portal_id", "c0619ab12345", "Portal ID of the simulated GX")
+	speed := fs.Float64("speed", 1, "Speed of simulated time relative to real time, for example 60 for an hour a minute")
+	start := fs.String("start", "", "Simulated start time in RFC 3339 format. Defaults to now")
+
+	err := fs.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	if fs.NArg() != 0 {
+		fs.Usage()
+
+		return errors.New("unexpected arguments")
+	}
+
+	setLogLevel(*logLevel)
+
+	startTime := time.Now()
+	if *start != "" {
+		startTime, err = time.Parse(time.RFC3339, *start)
+		if err != nil {
+			return fmt.Errorf("invalid start time: %w", err)
+		}
+	}
+
+	if *speed <= 0 {
+		return errors.New("speed must be positive")
+	}
+
+	l, err := net.Listen("tcp", *listen)
+	if err != nil {
+		return err
+	}
+
+	sim := newSimulator(*portalID, startTime, *speed)
+
+	go sim.run(ctx)
+
+	fmt.Fprintf(os.Stderr, "simulating GX %s on mqtt://%s\n", *portalID, l.Addr())
+
+	return sim.server.serve(ctx, l)
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestExporterAgainstSimulator runs a site against the simulator and
+// checks the series scraped from the metrics endpoint.
+func TestExporterAgainstSimulator(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sim := newSimulator("c0619ab12345", time.Date(2022, 6, 21, 12, 0, 0, 0, time.UTC), 1)
+
+	go sim.run(ctx)
+	go func() { _ = sim.server.serve(ctx, l) }()
+
+	s, err := newSite(siteConfig{
+		Name:           "test",
+		brokerSettings: brokerSettings{URL: "tcp://" + l.Addr().String()},
+	}, siteOptions{
+		clientPrefix:     "test",
+		keepaliveMode:    keepaliveModeAuto,
+		pollInterval:     100 * time.Millisecond,
+		connectTimeout:   5 * time.Second,
+		watchdogTimeout:  time.Minute,
+		failoverTimeout:  time.Minute,
+		failbackInterval: time.Hour,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan error, 1)
+	go func() { done <- s.run(ctx) }()
+
+	want := []string{
+		`victron_mode{component_id="276",component_type="vebus",portal_id="c0619ab12345",site="test"} 3`,
+		`victron_ac_input_current_limit{component_id="276",component_type="vebus",input="1",portal_id="c0619ab12345",site="test"} 16`,
+		`victron_dc_temperature_celsius{component_id="512",component_type="battery",n="0",portal_id="c0619ab12345",site="test"} 22`,
+		`victron_mqtt_connection_state{client_id="test_test_sub",site="test"} 1`,
+	}
+
+	var body string
+
+	for deadline := time.Now().Add(10 * time.Second); time.Now().Before(deadline); time.Sleep(100 * time.Millisecond) {
+		rec := httptest.NewRecorder()
+		metricsHandler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+		body = rec.Body.String()
+
+		if containsAll(body, want) {
+			break
+		}
+	}
+
+	for _, series := range want {
+		if !strings.Contains(body, series) {
+			t.Errorf("series not scraped: %s", series)
+		}
+	}
+
+	cancel()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("site.run() error = %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("site did not stop")
+	}
+}
+
+func containsAll(s string, substrs []string) bool {
+	for _, substr := range substrs {
+		if !strings.Contains(s, substr) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func TestSimulatorLegacyKeepalive(t *testing.T) {
+	sim := newSimulator("c0619ab12345", time.Now(), 1)
+
+	if sim.alive(time.Now()) {
+		t.Fatal("simulator publishing before any keepalive")
+	}
+
+	sim.handlePublish("R/c0619ab12345/system/0/Serial", nil)
+
+	if !sim.alive(time.Now()) {
+		t.Error("reading the serial number did not extend the keepalive")
+	}
+}
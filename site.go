@@ -0,0 +1,256 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	log "github.com/sirupsen/logrus"
+)
+
+// siteOptions are the settings shared by every site.
+type siteOptions struct {
+	clientPrefix    string
+	keepaliveMode   string
+	pollInterval    time.Duration
+	subscribeAll    bool
+	connectTimeout  time.Duration
+	watchdogTimeout time.Duration
+	// failoverTimeout is how long the active broker may be unavailable
+	// before the site switches to another
+	failoverTimeout time.Duration
+	// failbackInterval is how often a site that has failed over tries
+	// to return to a more preferred broker
+	failbackInterval time.Duration
+	// singleClient uses one mqtt connection for both subscribing and
+	// publishing keepalives, rather than one of each
+	singleClient bool
+	// writeAPI subscribes to the paths that can be written through the
+	// HTTP API, so that writes can be confirmed
+	writeAPI bool
+	// recorder, if set, records every message received
+	recorder *recorder
+}
+
+// site is a single GX device or VRM installation monitored by the
+// exporter, with its own mqtt connections and keepalive loop.
+type site struct {
+	name        string
+	opts        siteOptions
+	brokers     []broker
+	subClientID string
+	pubClientID string
+	portal      *portalIDTracker
+	keepalive   *keepaliveState
+	watchdog    *watchdog
+	writes      writeWaiters
+
+	mu   sync.RWMutex
+	conn *brokerConnection
+	// lastFailback is when the site last tried to return to a more
+	// preferred broker
+	lastFailback time.Time
+
+	// lastMessage is the unix time in nanoseconds at which the last
+	// message for this site was received, accessed atomically
+	lastMessage int64
+	// reconnecting is 1 while the watchdog is reconnecting the
+	// subscription, accessed atomically
+	reconnecting int32
+}
+
+func newSite(cfg siteConfig, opts siteOptions) (*site, error) {
+	keepalive, err := newKeepaliveState(opts.keepaliveMode)
+	if err != nil {
+		return nil, err
+	}
+
+	var brokers []broker
+
+	for _, b := range cfg.brokers() {
+		config, err := b.connectionConfig(cfg.PortalID)
+		if err != nil {
+			return nil, fmt.Errorf("broker %q: %w", b.Name, err)
+		}
+
+		brokers = append(brokers, broker{name: b.Name, config: config})
+	}
+
+	s := &site{
+		name:        cfg.Name,
+		opts:        opts,
+		brokers:     brokers,
+		subClientID: siteClientID(cfg.Name, opts.clientPrefix, "sub"),
+		pubClientID: siteClientID(cfg.Name, opts.clientPrefix, "pub"),
+		keepalive:   keepalive,
+		watchdog:    &watchdog{timeout: opts.watchdogTimeout},
+	}
+
+	if opts.singleClient {
+		s.subClientID = siteClientID(cfg.Name, opts.clientPrefix, "")
+		s.pubClientID = s.subClientID
+	}
+	s.portal = &portalIDTracker{site: s.name, pinned: cfg.PortalID}
+
+	return s, nil
+}
+
+func (s *site) logger() *log.Entry {
+	return log.WithField("site", s.name)
+}
+
+// siteClientID returns the mqtt client ID for one of a site's
+// connections. The default site keeps the client IDs used before
+// multiple sites were supported.
+func siteClientID(siteName string, prefix string, suffix string) string {
+	parts := []string{prefix}
+	if siteName != defaultSiteName {
+		parts = append(parts, siteName)
+	}
+
+	if suffix != "" {
+		parts = append(parts, suffix)
+	}
+
+	return strings.Join(parts, "_")
+}
+
+// clientIDs returns the distinct client IDs of the site's connections.
+func (s *site) clientIDs() []string {
+	if s.subClientID == s.pubClientID {
+		return []string{s.subClientID}
+	}
+
+	return []string{s.subClientID, s.pubClientID}
+}
+
+func (s *site) messageReceived(t time.Time) {
+	atomic.StoreInt64(&s.lastMessage, t.UnixNano())
+}
+
+// lastMessageTime returns when the last message was received, or the
+// zero time if none has been.
+func (s *site) lastMessageTime() time.Time {
+	n := atomic.LoadInt64(&s.lastMessage)
+	if n == 0 {
+		return time.Time{}
+	}
+
+	return time.Unix(0, n)
+}
+
+// connection returns the site's active broker connection.
+func (s *site) connection() *brokerConnection {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.conn
+}
+
+// run connects to the site and publishes keepalive requests every
+// poll interval until ctx is done. It returns an error if none of the
+// site's brokers can be connected to within the connect timeout.
+func (s *site) run(ctx context.Context) error {
+	s.portal.set(s.portal.pinned)
+
+	conn, err := s.connectPreferred(ctx, len(s.brokers))
+	if ctx.Err() != nil {
+		// Stopped before connecting, either on shutdown or because the
+		// site was removed from the configuration
+		return nil
+	}
+
+	if err != nil {
+		return err
+	}
+
+	s.lastFailback = time.Now()
+	s.switchConnection(conn)
+	defer func() {
+		s.logger().Info("disconnecting from mqtt")
+		s.connection().disconnect()
+	}()
+
+	timer := time.NewTicker(s.opts.pollInterval)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-timer.C:
+		}
+
+		now := time.Now()
+		s.checkBrokerHealth(ctx, now)
+		conn := s.connection()
+
+		if !conn.pub.IsConnectionOpen() {
+			s.logger().Debug("mqtt connection not yet established")
+
+			continue
+		}
+
+		// Check whether we've heard back from victron mqtt yet...
+		portalID := s.portal.get()
+		if portalID == "" {
+			s.logger().Debug("awaiting portal ID from Victron mqtt bus")
+
+			continue
+		}
+
+		err := s.publishKeepalive(ctx, conn.pub, portalID)
+		if ctx.Err() != nil {
+			return nil
+		}
+
+		if err != nil {
+			keepalivePublishesTotal.WithLabelValues(s.name, "failure").Inc()
+			s.logger().WithError(err).Error("mqtt publish failed")
+
+			continue
+		}
+
+		keepalivePublishesTotal.WithLabelValues(s.name, "success").Inc()
+
+		if !conn.sub.IsConnectionOpen() {
+			s.watchdog.reset()
+
+			continue
+		}
+
+		s.watchdog.keepaliveSent(now, s.lastMessageTime())
+		if s.watchdog.expired(now, s.lastMessageTime()) {
+			s.watchdog.reset()
+
+			if len(s.brokers) > 1 {
+				s.failover(ctx, "no mqtt messages received since keepalive")
+			} else {
+				s.reconnectSubscription(ctx)
+			}
+		}
+	}
+}
+
+// publishKeepalive publishes a keepalive request and waits for it to be
+// acknowledged. The wait is abandoned when ctx is done, as paho holds the
+// publish until it reconnects.
+func (s *site) publishKeepalive(ctx context.Context, client mqtt.Client, portalID string) error {
+	topic, payload := s.keepalive.nextRequest(portalID)
+	token := client.Publish(topic, 1, false, payload)
+
+	for {
+		select {
+		case <-token.Done():
+			return token.Error()
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(5 * time.Second):
+			s.logger().WithField("topic", topic).Debug("waiting for mqtt publish to complete")
+		}
+	}
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestSiteStopsWhileWaitingForKeepalive checks that a site whose keepalive
+// publish is never acknowledged still stops when its context is done.
+func TestSiteStopsWhileWaitingForKeepalive(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+
+	keepalive := make(chan struct{}, 1)
+
+	// The broker acknowledges a publish before passing it on, so blocking
+	// here holds back the acknowledgement of every later keepalive
+	server := newMQTTServer(func(topic string, payload []byte) {
+		if strings.HasSuffix(topic, "/keepalive") || strings.HasSuffix(topic, "/Serial") {
+			select {
+			case keepalive <- struct{}{}:
+			default:
+			}
+
+			<-release
+		}
+	})
+	server.publish("N/c0619ab12345/system/0/Serial", []byte(`{"value": "c0619ab12345"}`), true)
+
+	s := newTestSite(t, "stop", startTestBroker(t, server))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	done := make(chan error, 1)
+	go func() { done <- s.run(ctx) }()
+
+	select {
+	case <-keepalive:
+	case <-time.After(5 * time.Second):
+		t.Fatal("no keepalive published")
+	}
+
+	// Let the site publish a keepalive that won't be acknowledged
+	time.Sleep(3 * testSiteOptions.pollInterval)
+	cancel()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("run() error = %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("site did not stop while waiting for a keepalive to be acknowledged")
+	}
+}
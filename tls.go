@@ -0,0 +1,141 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+type tlsSettings struct {
+	// CAFile is a PEM bundle of CAs used to verify the broker. The
+	// embedded Venus CA is used when neither CAFile nor SystemRoots is set.
+	CAFile      string `yaml:"ca_file"`
+	SystemRoots bool   `yaml:"system_roots"`
+	CertFile    string `yaml:"cert_file"`
+	KeyFile     string `yaml:"key_file"`
+	ServerName  string `yaml:"server_name"`
+	// InsecureSkipVerify disables all verification of the broker certificate
+	InsecureSkipVerify bool `yaml:"insecure_skip_verify"`
+}
+
+var errCertWithoutKey = errors.New("client certificate and key must be given together")
+
+// newTLSConfig builds the TLS configuration for connecting to host.
+func newTLSConfig(settings tlsSettings, host string) (*tls.Config, error) {
+	roots, err := rootCAs(settings)
+	if err != nil {
+		return nil, err
+	}
+
+	config := &tls.Config{
+		RootCAs:            roots,
+		ServerName:         settings.ServerName,
+		InsecureSkipVerify: settings.InsecureSkipVerify, //nolint:gosec
+		MinVersion:         tls.VersionTLS12,
+	}
+
+	if (settings.CertFile == "") != (settings.KeyFile == "") {
+		return nil, errCertWithoutKey
+	}
+
+	if settings.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(settings.CertFile, settings.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load client certificate: %w", err)
+		}
+
+		config.Certificates = []tls.Certificate{cert}
+	}
+
+	// Certificates on a local GX are signed by the Venus CA but don't
+	// carry its IP address or hostname, so only the chain is verified.
+	// VRM brokers have certificates issued for their hostnames.
+	if !settings.InsecureSkipVerify && usesVenusCA(settings) && settings.ServerName == "" && !isVRMBroker(host) {
+		config.InsecureSkipVerify = true //nolint:gosec
+		config.VerifyPeerCertificate = verifyChain(roots)
+	}
+
+	return config, nil
+}
+
+func usesVenusCA(settings tlsSettings) bool {
+	return settings.CAFile == "" && !settings.SystemRoots
+}
+
+func isVRMBroker(host string) bool {
+	return strings.HasSuffix(host, ".victronenergy.com")
+}
+
+func rootCAs(settings tlsSettings) (*x509.CertPool, error) {
+	if usesVenusCA(settings) {
+		roots := x509.NewCertPool()
+		if !roots.AppendCertsFromPEM([]byte(rootPEM)) {
+			return nil, errors.New("failed to parse embedded Venus CA certificate")
+		}
+
+		return roots, nil
+	}
+
+	roots := x509.NewCertPool()
+
+	if settings.SystemRoots {
+		var err error
+
+		roots, err = x509.SystemCertPool()
+		if err != nil {
+			return nil, fmt.Errorf("failed to load system root certificates: %w", err)
+		}
+	}
+
+	if settings.CAFile != "" {
+		b, err := os.ReadFile(settings.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read CA file: %w", err)
+		}
+
+		if !roots.AppendCertsFromPEM(b) {
+			return nil, fmt.Errorf("no certificates found in CA file %s", settings.CAFile)
+		}
+	}
+
+	return roots, nil
+}
+
+// verifyChain returns a certificate verifier that checks the broker's
+// certificate chains to roots, without checking the hostname.
+func verifyChain(roots *x509.CertPool) func([][]byte, [][]*x509.Certificate) error {
+	return func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+		if len(rawCerts) == 0 {
+			return errors.New("broker did not present a certificate")
+		}
+
+		certs := make([]*x509.Certificate, 0, len(rawCerts))
+
+		for _, raw := range rawCerts {
+			cert, err := x509.ParseCertificate(raw)
+			if err != nil {
+				return fmt.Errorf("failed to parse broker certificate: %w", err)
+			}
+
+			certs = append(certs, cert)
+		}
+
+		intermediates := x509.NewCertPool()
+		for _, cert := range certs[1:] {
+			intermediates.AddCert(cert)
+		}
+
+		_, err := certs[0].Verify(x509.VerifyOptions{
+			Roots:         roots,
+			Intermediates: intermediates,
+		})
+		if err != nil {
+			return fmt.Errorf("failed to verify broker certificate: %w", err)
+		}
+
+		return nil
+	}
+}
@@ -1,43 +1,119 @@
 package main
 
 import (
+	"strings"
+	"sync"
+
 	"github.com/prometheus/client_golang/prometheus"
 )
 
-type mqttObserver func(componentType string, componentId string, value float64)
+// mqttObserver exports the values of a path as a metric.
+type mqttObserver struct {
+	// name is the metric name, without the victron_ prefix
+	name      string
+	collector *timestampedVec
+	observe   func(site string, portalID string, componentType string, componentId string, value float64)
+}
 
-var labels = []string{"component_type", "component_id"}
+var labels = []string{"site", "portal_id", "component_type", "component_id"}
 
 func gaugeObserver(opts prometheus.GaugeOpts) mqttObserver {
+	o, err := newGaugeObserver(opts)
+	if err != nil {
+		panic(err)
+	}
+
+	return o
+}
+
+func newGaugeObserver(opts prometheus.GaugeOpts) (mqttObserver, error) {
 	opts.Namespace = namespace
 	gauge := prometheus.NewGaugeVec(opts, labels)
-	prometheus.MustRegister(gauge)
+	collector := newTimestampedVec(gauge, labels)
+
+	err := registerSiteMetric(collector, gauge.MetricVec)
+	if err != nil {
+		return mqttObserver{}, err
+	}
+
+	return mqttObserver{
+		name:      opts.Name,
+		collector: collector,
+		observe: func(site string, portalID string, componentType string, componentId string, value float64) {
+			gauge.WithLabelValues(site, portalID, componentType, componentId).Set(value)
+		},
+	}, nil
+}
+
+// mqttElementObserver exports the elements of an array or object value,
+// labelled with their index or key.
+type mqttElementObserver struct {
+	name      string
+	collector *timestampedVec
+	observe   func(site string, portalID string, componentType string, componentId string, key string, value float64)
+}
+
+func newElementGaugeObserver(opts prometheus.GaugeOpts, keyLabel string) (mqttElementObserver, error) {
+	opts.Namespace = namespace
+	elementLabels := append(append([]string{}, labels...), keyLabel)
+	gauge := prometheus.NewGaugeVec(opts, elementLabels)
+	collector := newTimestampedVec(gauge, elementLabels)
 
-	return func(componentType string, componentId string, value float64) {
-		gauge.WithLabelValues(componentType, componentId).Set(value)
+	err := registerSiteMetric(collector, gauge.MetricVec)
+	if err != nil {
+		return mqttElementObserver{}, err
 	}
+
+	return mqttElementObserver{
+		name:      opts.Name,
+		collector: collector,
+		observe: func(site string, portalID string, componentType string, componentId string, key string, value float64) {
+			gauge.WithLabelValues(site, portalID, componentType, componentId, key).Set(value)
+		},
+	}, nil
 }
 
 func counterObserver(opts prometheus.CounterOpts) mqttObserver {
+	o, err := newCounterObserver(opts)
+	if err != nil {
+		panic(err)
+	}
+
+	return o
+}
+
+func newCounterObserver(opts prometheus.CounterOpts) (mqttObserver, error) {
 	opts.Namespace = namespace
 	counter := prometheus.NewCounterVec(opts, labels)
-	prometheus.MustRegister(counter)
-	var prevValue float64
-	first := true
+	collector := newTimestampedVec(counter, labels)
 
-	return func(componentType string, componentId string, value float64) {
-		if first {
-			prevValue = value
-			first = false
+	err := registerSiteMetric(collector, counter.MetricVec)
+	if err != nil {
+		return mqttObserver{}, err
+	}
 
+	prevValues := map[string]float64{}
+
+	var mu sync.Mutex
+
+	observe := func(site string, portalID string, componentType string, componentId string, value float64) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		key := strings.Join([]string{site, portalID, componentType, componentId}, "/")
+		prevValue, ok := prevValues[key]
+		prevValues[key] = value
+
+		if !ok {
 			return
 		}
 
 		if prevValue <= value {
-			counter.WithLabelValues(componentType, componentId).Add(value - prevValue)
+			counter.WithLabelValues(site, portalID, componentType, componentId).Add(value - prevValue)
 		}
-		prevValue = value
 	}
+
+	return mqttObserver{name: opts.Name, collector: collector, observe: observe}, nil
 }
 
 func alarm(alarmType string) mqttObserver {
@@ -60,6 +136,10 @@ func phaseAlarm(phase string, alarmType string) mqttObserver {
 	return gaugeObserver(gauge)
 }
 
+// elementTopicMap maps paths with array or object values to observers
+// of their elements. It is filled from mappings that set expand.
+var elementTopicMap = map[string]mqttElementObserver{}
+
 // These paths are documented at
 // https://github.com/victronenergy/venus/wiki/dbus
 
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"errors"
+	"math"
+)
+
+// transformConfig adjusts the values of a path before they are exported,
+// for example to convert units or to flip the sign of a meter that is
+// wired the other way round.
+//
+// A null value is replaced by NullValue, if set, and is otherwise left as
+// NaN. Other values are inverted, scaled, offset, clamped to Min and Max
+// and then rounded, in that order.
+type transformConfig struct {
+	Scale  *float64 `yaml:"scale"`
+	Offset float64  `yaml:"offset"`
+	Invert bool     `yaml:"invert"`
+	// Round is the number of decimal places to round to
+	Round     *int     `yaml:"round"`
+	Min       *float64 `yaml:"min"`
+	Max       *float64 `yaml:"max"`
+	NullValue *float64 `yaml:"null_value"`
+}
+
+// transformTopicMap holds the transforms for paths, applied by the
+// subscription handler before values reach the observers.
+var transformTopicMap = map[string]*transformConfig{}
+
+func (t *transformConfig) validate() error {
+	if t.Scale != nil && *t.Scale == 0 {
+		return errors.New("scale must not be 0")
+	}
+
+	if t.Round != nil && (*t.Round < 0 || *t.Round > 15) {
+		return errors.New("round must be between 0 and 15")
+	}
+
+	if t.Min != nil && t.Max != nil && *t.Min > *t.Max {
+		return errors.New("min must not be greater than max")
+	}
+
+	return nil
+}
+
+func (t *transformConfig) apply(v float64) float64 {
+	if math.IsNaN(v) {
+		if t.NullValue != nil {
+			return *t.NullValue
+		}
+
+		return v
+	}
+
+	if t.Invert {
+		v = -v
+	}
+
+	if t.Scale != nil {
+		v *= *t.Scale
+	}
+
+	v += t.Offset
+
+	if t.Min != nil && v < *t.Min {
+		v = *t.Min
+	}
+
+	if t.Max != nil && v > *t.Max {
+		v = *t.Max
+	}
+
+	if t.Round != nil {
+		p := math.Pow(10, float64(*t.Round))
+		v = math.Round(v*p) / p
+	}
+
+	return v
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func float(f float64) *float64 { return &f }
+
+func intPtr(i int) *int { return &i }
+
+func TestTransformApply(t *testing.T) {
+	tests := []struct {
+		name      string
+		transform transformConfig
+		in        float64
+		want      float64
+	}{
+		{"scale", transformConfig{Scale: float(1000)}, 1.5, 1500},
+		{"offset", transformConfig{Offset: -273}, 300, 27},
+		// Inverting comes before scaling and offsetting
+		{"invert", transformConfig{Invert: true, Scale: float(2), Offset: 10}, 3, 4},
+		// Clamping comes after the offset
+		{"clamp max", transformConfig{Offset: 50, Max: float(100)}, 60, 100},
+		{"clamp min", transformConfig{Invert: true, Min: float(0)}, 5, 0},
+		// Rounding comes last, so a clamped value is rounded too
+		{"round", transformConfig{Scale: float(1.0 / 3), Max: float(0.5), Round: intPtr(2)}, 1, 0.33},
+		{"round clamped", transformConfig{Min: float(0.555), Round: intPtr(2)}, 0, 0.56},
+		{"round to integer", transformConfig{Round: intPtr(0)}, 2.5, 3},
+		// Null is replaced and not transformed further
+		{"null value", transformConfig{NullValue: float(0), Offset: 10, Invert: true}, math.NaN(), 0},
+		{"null", transformConfig{Offset: 10}, math.NaN(), math.NaN()},
+	}
+
+	for _, tt := range tests {
+		got := tt.transform.apply(tt.in)
+		if !sameFloat(got, tt.want) {
+			t.Errorf("%s: apply(%g) = %g, want %g", tt.name, tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestTransformValidate(t *testing.T) {
+	tests := []struct {
+		name      string
+		transform transformConfig
+		valid     bool
+	}{
+		{"empty", transformConfig{}, true},
+		{"min equals max", transformConfig{Min: float(1), Max: float(1)}, true},
+		{"min above max", transformConfig{Min: float(2), Max: float(1)}, false},
+		{"zero scale", transformConfig{Scale: float(0)}, false},
+		{"round 0", transformConfig{Round: intPtr(0)}, true},
+		{"negative round", transformConfig{Round: intPtr(-1)}, false},
+		{"round too large", transformConfig{Round: intPtr(16)}, false},
+	}
+
+	for _, tt := range tests {
+		err := tt.transform.validate()
+		if (err == nil) != tt.valid {
+			t.Errorf("%s: validate() error = %v, want valid %t", tt.name, err, tt.valid)
+		}
+	}
+}
+
+// TestTransformOverrideRenamed checks that a transform of a built-in path
+// applies once when the metric is also renamed and converted to base
+// units in prometheus naming mode.
+func TestTransformOverrideRenamed(t *testing.T) {
+	mappings := []mappingConfig{{Path: "Yield/User", Transform: &transformConfig{Scale: float(2)}}}
+
+	err := validateMappings(mappings)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = registerMappings(mappings)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer delete(transformTopicMap, "Yield/User")
+
+	s := newTestSite(t, "transform", "tcp://127.0.0.1:1")
+
+	s.handleMessage(replayMessage{topic: "N/c0619ab12345/system/0/Serial", payload: []byte(`{"value": "c0619ab12345"}`)}, time.Now())
+	s.handleMessage(replayMessage{topic: "N/c0619ab12345/solarcharger/279/Yield/User", payload: []byte(`{"value": 1.5}`)}, time.Now())
+
+	mfs, err := namingGatherer{gatherer: prometheus.DefaultGatherer, naming: namingPrometheus}.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	found := false
+
+	for _, mf := range mfs {
+		if mf.GetName() != "victron_yield_user_joules_total" {
+			continue
+		}
+
+		for _, m := range mf.Metric {
+			for _, l := range m.Label {
+				if l.GetName() != "site" || l.GetValue() != "transform" {
+					continue
+				}
+
+				found = true
+
+				if got, want := m.GetCounter().GetValue(), 1.5*2*kilowattHoursToJoules; got != want {
+					t.Errorf("%s = %g, want %g", mf.GetName(), got, want)
+				}
+			}
+		}
+	}
+
+	if !found {
+		t.Error("transformed yield not exported")
+	}
+}
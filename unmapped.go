@@ -0,0 +1,443 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+	"unicode"
+)
+
+// maxUnmappedPaths bounds the number of unmapped paths tracked, as a
+// misbehaving device could publish any number of them.
+const maxUnmappedPaths = 2000
+
+// unmappedPath is a path that was received but isn't mapped to a metric.
+type unmappedPath struct {
+	ComponentType string    `json:"component_type"`
+	Path          string    `json:"path"`
+	Count         uint64    `json:"count"`
+	Sample        string    `json:"sample"`
+	LastSeen      time.Time `json:"last_seen"`
+}
+
+// unmappedPaths records the unmapped paths received by every site.
+type unmappedPaths struct {
+	mu    sync.Mutex
+	paths map[string]*unmappedPath
+}
+
+var unmapped = &unmappedPaths{paths: map[string]*unmappedPath{}}
+
+func (u *unmappedPaths) record(componentType string, path string, payload []byte, t time.Time) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	key := componentType + "/" + path
+
+	p, ok := u.paths[key]
+	if !ok {
+		if len(u.paths) >= maxUnmappedPaths {
+			return
+		}
+
+		p = &unmappedPath{ComponentType: componentType, Path: path}
+		u.paths[key] = p
+	}
+
+	p.Count++
+	p.Sample = string(payload)
+	p.LastSeen = t
+}
+
+// list returns the unmapped paths, most frequently received first.
+func (u *unmappedPaths) list() []unmappedPath {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	paths := make([]unmappedPath, 0, len(u.paths))
+	for _, p := range u.paths {
+		paths = append(paths, *p)
+	}
+
+	sort.Slice(paths, func(i, j int) bool {
+		if paths[i].Count != paths[j].Count {
+			return paths[i].Count > paths[j].Count
+		}
+
+		return paths[i].ComponentType+"/"+paths[i].Path < paths[j].ComponentType+"/"+paths[j].Path
+	})
+
+	return paths
+}
+
+// errUnmappedNotRecorded explains why there are no unmapped paths to list.
+var errUnmappedNotRecorded = errors.New("unmapped paths are only received when the exporter runs with -mqtt.subscribe_all")
+
+// newUnmappedHandler lists the unmapped paths as a table, or as JSON with
+// ?format=json. Only mapped paths are subscribed to without subscribeAll,
+// so the handler then answers 404 with an explanation instead of an empty
+// list.
+func newUnmappedHandler(subscribeAll bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !subscribeAll {
+			if r.URL.Query().Get("format") == "json" {
+				writeJSON(w, http.StatusNotFound, apiError{errUnmappedNotRecorded.Error()})
+
+				return
+			}
+
+			http.Error(w, errUnmappedNotRecorded.Error(), http.StatusNotFound)
+
+			return
+		}
+
+		listUnmapped(w, r)
+	}
+}
+
+func listUnmapped(w http.ResponseWriter, r *http.Request) {
+	paths := unmapped.list()
+
+	if r.URL.Query().Get("format") == "json" {
+		writeJSON(w, http.StatusOK, paths)
+
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "COMPONENT TYPE\tPATH\tCOUNT\tLAST SEEN\tSAMPLE")
+
+	for _, p := range paths {
+		fmt.Fprintf(tw, "%s\t%s\t%d\t%s\t%s\n", p.ComponentType, p.Path, p.Count, p.LastSeen.Format(time.RFC3339), p.Sample)
+	}
+
+	tw.Flush()
+}
+
+// runMappingStubs prints draft mappings for the unmapped paths reported
+// by a running exporter.
+func runMappingStubs(ctx context.Context, fs *flag.FlagSet, args []string) error {
+	url := fs.String("url", "http://127.0.0.1:9226/debug/unmapped", "URL of a running exporter's unmapped paths page")
+	format := fs.String("format", "go", "Output format: go for topics.go, or yaml for the mappings section of a config file")
+
+	err := fs.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	if *format != "go" && *format != "yaml" {
+		return fmt.Errorf("unknown format %q", *format)
+	}
+
+	paths, err := fetchUnmapped(ctx, *url)
+	if err != nil {
+		return err
+	}
+
+	stubs := newMappingStubs(paths)
+	if len(stubs) == 0 {
+		return errors.New("no unmapped paths have been received yet")
+	}
+
+	if *format == "yaml" {
+		fmt.Println("mappings:")
+	}
+
+	for _, stub := range stubs {
+		if *format == "yaml" {
+			stub.writeYAML(os.Stdout)
+		} else {
+			stub.writeGo(os.Stdout)
+		}
+	}
+
+	return nil
+}
+
+func fetchUnmapped(ctx context.Context, url string) ([]unmappedPath, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url+"?format=json", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		var apiErr apiError
+		if json.NewDecoder(io.LimitReader(resp.Body, 4096)).Decode(&apiErr) == nil && apiErr.Error != "" {
+			return nil, fmt.Errorf("%s returned %s: %s", url, resp.Status, apiErr.Error)
+		}
+
+		return nil, fmt.Errorf("%s returned %s", url, resp.Status)
+	}
+
+	var paths []unmappedPath
+
+	err = json.NewDecoder(resp.Body).Decode(&paths)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode unmapped paths: %w", err)
+	}
+
+	return paths, nil
+}
+
+// mappingStub is a suggested mapping for an unmapped path.
+type mappingStub struct {
+	path           string
+	name           string
+	labels         map[string]string
+	componentTypes []string
+	sample         string
+	shape          string
+	// scale converts the published value to the unit in the name
+	scale float64
+}
+
+var phaseSegment = regexp.MustCompile(`^L([123])$`)
+
+// newMappingStubs suggests a mapping for each unmapped path, in the
+// style of the mappings in topics.go.
+func newMappingStubs(paths []unmappedPath) []mappingStub {
+	byPath := map[string]*mappingStub{}
+
+	for _, p := range paths {
+		if stub, ok := byPath[p.Path]; ok {
+			stub.componentTypes = append(stub.componentTypes, p.ComponentType)
+
+			continue
+		}
+
+		name, labels, scale := suggestMetricName(p.Path)
+
+		var shape string
+		if v, err := decodePayload([]byte(p.Sample)); err == nil {
+			shape = v.shape
+		}
+
+		byPath[p.Path] = &mappingStub{
+			path:           p.Path,
+			name:           name,
+			labels:         labels,
+			componentTypes: []string{p.ComponentType},
+			sample:         p.Sample,
+			shape:          shape,
+			scale:          scale,
+		}
+	}
+
+	stubs := make([]mappingStub, 0, len(byPath))
+	for _, stub := range byPath {
+		sort.Strings(stub.componentTypes)
+		stubs = append(stubs, *stub)
+	}
+
+	sort.Slice(stubs, func(i, j int) bool { return stubs[i].path < stubs[j].path })
+
+	return stubs
+}
+
+// unitSuggestion is the name and base unit to use for the last segment of
+// a path, and the scale from the published unit to the base unit.
+type unitSuggestion struct {
+	name  string
+	unit  string
+	scale float64
+}
+
+// units maps the last segment of a path to the name and unit to use for
+// it. Short segments such as V are spelled out.
+var units = map[string]unitSuggestion{
+	"v":           {name: "voltage", unit: "volts"},
+	"voltage":     {name: "voltage", unit: "volts"},
+	"i":           {name: "current", unit: "amperes"},
+	"current":     {name: "current", unit: "amperes"},
+	"p":           {name: "power", unit: "watts"},
+	"power":       {name: "power", unit: "watts"},
+	"f":           {name: "frequency", unit: "hertz"},
+	"frequency":   {name: "frequency", unit: "hertz"},
+	"temperature": {name: "temperature", unit: "celsius"},
+	"forward":     {name: "forward", unit: "joules_total", scale: kilowattHoursToJoules},
+	"reverse":     {name: "reverse", unit: "joules_total", scale: kilowattHoursToJoules},
+	"timetogo":    {name: "time_to_go", unit: "seconds"},
+}
+
+// suggestMetricName turns a path such as Ac/L1/Power into a metric name
+// and labels, here ac_phase_power_watts with phase="1". Device numbers
+// such as the 1 in Dc/1/Voltage become an n label, and any after it n2,
+// n3 and so on. Names follow the
+// Prometheus conventions, so the returned scale converts the published
+// value to the unit in the name, or is 0 if the value needs no scaling.
+func suggestMetricName(path string) (string, map[string]string, float64) {
+	segments := strings.Split(path, "/")
+	labels := map[string]string{}
+
+	var (
+		parts []string
+		scale float64
+	)
+
+	for i, segment := range segments {
+		last := i == len(segments)-1
+
+		if m := phaseSegment.FindStringSubmatch(segment); m != nil {
+			labels["phase"] = m[1]
+			parts = append(parts, "phase")
+
+			continue
+		}
+
+		if isNumber(segment) {
+			// Further device numbers are labelled n2, n3 and so on
+			label := "n"
+			for k := 2; labels[label] != ""; k++ {
+				label = fmt.Sprintf("n%d", k)
+			}
+
+			labels[label] = segment
+
+			continue
+		}
+
+		if unit, ok := units[strings.ToLower(segment)]; ok && last {
+			parts = append(parts, unit.name, unit.unit)
+			scale = unit.scale
+
+			continue
+		}
+
+		parts = append(parts, snakeCase(segment))
+	}
+
+	return strings.Join(parts, "_"), labels, scale
+}
+
+// snakeCase converts CamelCase to snake_case, keeping acronyms together.
+func snakeCase(s string) string {
+	runes := []rune(s)
+
+	var b strings.Builder
+
+	for i, r := range runes {
+		if i > 0 && unicode.IsUpper(r) {
+			prev := runes[i-1]
+			nextLower := i+1 < len(runes) && unicode.IsLower(runes[i+1])
+
+			if unicode.IsLower(prev) || unicode.IsDigit(prev) || (unicode.IsUpper(prev) && nextLower) {
+				b.WriteByte('_')
+			}
+		}
+
+		b.WriteRune(unicode.ToLower(r))
+	}
+
+	return b.String()
+}
+
+func (s mappingStub) comment() string {
+	comment := fmt.Sprintf("seen on %s, sample %s", strings.Join(s.componentTypes, ", "), s.sample)
+	switch s.shape {
+	case shapeNumber, shapeBool, shapeNull:
+	case shapeArray, shapeObject:
+		comment += " (" + s.shape + ", needs expand)"
+	default:
+		comment += " (not a number, can't be exported)"
+	}
+
+	return comment
+}
+
+// counter reports whether the suggested name is for a counter.
+func (s mappingStub) counter() bool {
+	return strings.HasSuffix(s.name, "_total")
+}
+
+func (s mappingStub) labelNames() []string {
+	names := make([]string, 0, len(s.labels))
+	for name := range s.labels {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	return names
+}
+
+func (s mappingStub) writeGo(w io.Writer) {
+	fmt.Fprintf(w, "\t// %s\n", s.comment())
+
+	if s.scale != 0 {
+		fmt.Fprintf(w, "\t// values need scaling by %g to match the unit in the name\n", s.scale)
+	}
+
+	if s.counter() {
+		fmt.Fprintf(w, "\t%q: counterObserver(\n\t\tprometheus.CounterOpts{\n", s.path)
+	} else {
+		fmt.Fprintf(w, "\t%q: gaugeObserver(\n\t\tprometheus.GaugeOpts{\n", s.path)
+	}
+
+	fmt.Fprintf(w, "\t\t\tName: %q,\n\t\t\tHelp: \"\",\n", s.name)
+
+	if len(s.labels) > 0 {
+		var labels []string
+		for _, name := range s.labelNames() {
+			labels = append(labels, fmt.Sprintf("%q: %q", name, s.labels[name]))
+		}
+
+		fmt.Fprintf(w, "\t\t\tConstLabels: prometheus.Labels{%s},\n", strings.Join(labels, ", "))
+	}
+
+	fmt.Fprintf(w, "\t\t}),\n")
+}
+
+func (s mappingStub) writeYAML(w io.Writer) {
+	expand := s.shape == shapeArray || s.shape == shapeObject
+	name := s.name
+
+	fmt.Fprintf(w, "  # %s\n", s.comment())
+
+	// Only gauges can be expanded, so a running total that needs expanding
+	// is suggested as a gauge, without the _total suffix of a counter
+	if expand && s.counter() {
+		name = strings.TrimSuffix(name, "_total")
+
+		fmt.Fprintf(w, "  # a running total, exported as a gauge as expanded mappings can't be counters\n")
+	}
+
+	fmt.Fprintf(w, "  - path: %s\n    name: %s\n    help: \"\"\n", s.path, name)
+
+	switch {
+	case expand:
+		fmt.Fprintf(w, "    expand: key\n")
+	case s.counter():
+		fmt.Fprintf(w, "    type: counter\n")
+	}
+
+	if len(s.labels) > 0 {
+		fmt.Fprintf(w, "    labels:\n")
+
+		for _, name := range s.labelNames() {
+			fmt.Fprintf(w, "      %s: %q\n", name, s.labels[name])
+		}
+	}
+
+	if s.scale != 0 {
+		fmt.Fprintf(w, "    transform:\n      scale: %g\n", s.scale)
+	}
+}
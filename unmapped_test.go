@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestSuggestMetricName(t *testing.T) {
+	tests := []struct {
+		path   string
+		name   string
+		labels map[string]string
+		scale  float64
+	}{
+		{"Ac/L1/Power", "ac_phase_power_watts", map[string]string{"phase": "1"}, 0},
+		{"Dc/1/Voltage", "dc_voltage_volts", map[string]string{"n": "1"}, 0},
+		{"Pv/2/Tracker/0/P", "pv_tracker_power_watts", map[string]string{"n": "2", "n2": "0"}, 0},
+		{"Ac/Energy/Forward", "ac_energy_forward_joules_total", map[string]string{}, kilowattHoursToJoules},
+	}
+
+	for _, tt := range tests {
+		name, labels, scale := suggestMetricName(tt.path)
+		if name != tt.name || !reflect.DeepEqual(labels, tt.labels) || scale != tt.scale {
+			t.Errorf("suggestMetricName(%q) = %q, %v, %g, want %q, %v, %g", tt.path, name, labels, scale, tt.name, tt.labels, tt.scale)
+		}
+	}
+}
+
+func TestMappingStubYAML(t *testing.T) {
+	tests := []struct {
+		sample  string
+		want    []string
+		notWant []string
+	}{
+		{`{"value": 12.5}`, []string{"name: ac_energy_forward_joules_total", "type: counter"}, []string{"expand"}},
+		{`{"value": [1, 2]}`, []string{"name: ac_energy_forward_joules\n", "expand: key"}, []string{"type: counter"}},
+	}
+
+	for _, tt := range tests {
+		stubs := newMappingStubs([]unmappedPath{{ComponentType: "grid", Path: "Ac/Energy/Forward", Sample: tt.sample}})
+
+		var b strings.Builder
+		stubs[0].writeYAML(&b)
+
+		for _, s := range tt.want {
+			if !strings.Contains(b.String(), s) {
+				t.Errorf("stub for sample %s does not contain %q:\n%s", tt.sample, s, b.String())
+			}
+		}
+
+		for _, s := range tt.notWant {
+			if strings.Contains(b.String(), s) {
+				t.Errorf("stub for sample %s contains %q:\n%s", tt.sample, s, b.String())
+			}
+		}
+	}
+}
+
+func TestUnmappedHandler(t *testing.T) {
+	tests := []struct {
+		subscribeAll bool
+		query        string
+		status       int
+		body         string
+	}{
+		{false, "", http.StatusNotFound, "-mqtt.subscribe_all"},
+		{false, "?format=json", http.StatusNotFound, `"error":`},
+		{true, "", http.StatusOK, "COMPONENT TYPE"},
+		{true, "?format=json", http.StatusOK, "["},
+	}
+
+	for _, tt := range tests {
+		rec := httptest.NewRecorder()
+		newUnmappedHandler(tt.subscribeAll).ServeHTTP(rec, httptest.NewRequest("GET", "/debug/unmapped"+tt.query, nil))
+
+		if rec.Code != tt.status || !strings.Contains(rec.Body.String(), tt.body) {
+			t.Errorf("subscribe_all %t: GET /debug/unmapped%s = %d %q, want %d containing %q", tt.subscribeAll, tt.query, rec.Code, rec.Body.String(), tt.status, tt.body)
+		}
+	}
+
+	server := httptest.NewServer(newUnmappedHandler(false))
+	defer server.Close()
+
+	_, err := fetchUnmapped(context.Background(), server.URL)
+	if err == nil || !strings.Contains(err.Error(), "-mqtt.subscribe_all") {
+		t.Errorf("fetchUnmapped() error = %v, want the explanation", err)
+	}
+}
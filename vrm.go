@@ -0,0 +1,188 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// The number of MQTT brokers that VRM shards installations across.
+const vrmBrokerCount = 128
+
+// vrmBrokerHost returns the VRM MQTT broker responsible for a portal ID.
+// The algorithm is documented at
+// https://github.com/victronenergy/dbus-mqtt#connecting-to-the-victron-mqtt-server
+func vrmBrokerHost(portalID string) string {
+	sum := 0
+	for _, c := range strings.ToLower(strings.TrimSpace(portalID)) {
+		sum += int(c)
+	}
+
+	return fmt.Sprintf("mqtt%d.victronenergy.com", sum%vrmBrokerCount)
+}
+
+// defaultVRMAPIURL is the base URL of the VRM API used to log in.
+const defaultVRMAPIURL = "https://vrmapi.victronenergy.com"
+
+// vrmTokenRefreshMargin is how long before expiry a login token is renewed.
+const vrmTokenRefreshMargin = 5 * time.Minute
+
+// vrmTokenDefaultLifetime is assumed when a login token has no expiry.
+const vrmTokenDefaultLifetime = time.Hour
+
+// vrmAccessTokenPassword returns the mqtt password that authenticates
+// with a VRM personal access token.
+func vrmAccessTokenPassword(token string) string {
+	return "Token " + token
+}
+
+// vrmLogin obtains mqtt credentials by logging in to the VRM API, and
+// logs in again when the token is about to expire.
+type vrmLogin struct {
+	apiURL     string
+	username   string
+	password   string
+	httpClient *http.Client
+
+	mu        sync.Mutex
+	token     string
+	expiresAt time.Time
+}
+
+func newVRMLogin(apiURL string, username string, password string) *vrmLogin {
+	return &vrmLogin{
+		apiURL:     strings.TrimSuffix(apiURL, "/"),
+		username:   username,
+		password:   password,
+		httpClient: &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+// credentials implements mqtt.CredentialsProvider. paho calls it for
+// every connection attempt, so the token is refreshed on reconnect. The
+// password is empty when there is no valid token, so that the attempt
+// fails without sending an empty bearer token.
+func (l *vrmLogin) credentials() (string, string) {
+	token, err := l.currentToken(time.Now())
+	if err != nil {
+		log.WithField("username", l.username).WithError(err).Error("failed to log in to VRM")
+	}
+
+	if token == "" {
+		return l.username, ""
+	}
+
+	return l.username, "Bearer " + token
+}
+
+// currentToken returns a token that is valid at now, logging in again
+// when the token is about to expire. If logging in fails the previous
+// token is returned along with the error, for as long as it is valid.
+func (l *vrmLogin) currentToken(now time.Time) (string, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.token != "" && now.Before(l.expiresAt.Add(-vrmTokenRefreshMargin)) {
+		return l.token, nil
+	}
+
+	err := l.login()
+	if err == nil {
+		return l.token, nil
+	}
+
+	if l.token != "" && now.Before(l.expiresAt) {
+		return l.token, err
+	}
+
+	return "", err
+}
+
+type vrmLoginRequest struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+type vrmLoginResponse struct {
+	Token string `json:"token"`
+}
+
+func (l *vrmLogin) login() error {
+	body, err := json.Marshal(vrmLoginRequest{Username: l.username, Password: l.password})
+	if err != nil {
+		return fmt.Errorf("failed to encode login request: %w", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), l.httpClient.Timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, l.apiURL+"/v2/auth/login", bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to create login request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := l.httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("login request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("login request failed: %s", resp.Status)
+	}
+
+	var r vrmLoginResponse
+
+	err = json.NewDecoder(resp.Body).Decode(&r)
+	if err != nil {
+		return fmt.Errorf("failed to decode login response: %w", err)
+	}
+
+	if r.Token == "" {
+		return errors.New("login response did not include a token")
+	}
+
+	l.token = r.Token
+	l.expiresAt = jwtExpiry(r.Token, time.Now().Add(vrmTokenDefaultLifetime))
+	log.WithFields(log.Fields{
+		"username":   l.username,
+		"expires_at": l.expiresAt,
+	}).Info("logged in to VRM")
+
+	return nil
+}
+
+// jwtExpiry returns the expiry time claimed by a JWT, or fallback if it
+// cannot be read. The signature is not verified: the token is only
+// passed on to the broker.
+func jwtExpiry(token string, fallback time.Time) time.Time {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return fallback
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return fallback
+	}
+
+	var claims struct {
+		Exp int64 `json:"exp"`
+	}
+
+	if json.Unmarshal(payload, &claims) != nil || claims.Exp == 0 {
+		return fallback
+	}
+
+	return time.Unix(claims.Exp, 0)
+}
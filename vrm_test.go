@@ -0,0 +1,169 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testJWT returns an unsigned JWT that expires at exp.
+func testJWT(exp time.Time) string {
+	payload := base64.RawURLEncoding.EncodeToString([]byte(fmt.Sprintf(`{"exp": %d}`, exp.Unix())))
+
+	return "eyJhbGciOiJub25lIn0." + payload + ".c2ln"
+}
+
+func TestJWTExpiry(t *testing.T) {
+	fallback := time.Unix(1000, 0)
+	exp := time.Unix(1700000000, 0)
+
+	tests := []struct {
+		name  string
+		token string
+		want  time.Time
+	}{
+		{"valid", testJWT(exp), exp},
+		{"not a jwt", "opaque-token", fallback},
+		{"invalid base64", "a.!!!.c", fallback},
+		{"invalid json", "a." + base64.RawURLEncoding.EncodeToString([]byte("{")) + ".c", fallback},
+		{"no exp", "a." + base64.RawURLEncoding.EncodeToString([]byte(`{"sub": "1"}`)) + ".c", fallback},
+	}
+
+	for _, tt := range tests {
+		got := jwtExpiry(tt.token, fallback)
+		if !got.Equal(tt.want) {
+			t.Errorf("%s: jwtExpiry() = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+// fakeVRMAPI serves the VRM login endpoint, issuing tokens that expire
+// after lifetime, or failing while fail is set.
+type fakeVRMAPI struct {
+	mu       sync.Mutex
+	logins   int
+	fail     bool
+	lifetime time.Duration
+	token    string
+}
+
+func (f *fakeVRMAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var req vrmLoginRequest
+	if r.URL.Path != "/v2/auth/login" || json.NewDecoder(r.Body).Decode(&req) != nil {
+		http.NotFound(w, r)
+
+		return
+	}
+
+	if f.fail || req.Username != "user@example.com" || req.Password != "secret" {
+		http.Error(w, `{"errors": "invalid credentials"}`, http.StatusUnauthorized)
+
+		return
+	}
+
+	f.logins++
+	f.token = testJWT(time.Now().Add(f.lifetime))
+
+	_ = json.NewEncoder(w).Encode(vrmLoginResponse{Token: f.token})
+}
+
+func (f *fakeVRMAPI) state() (int, string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.logins, f.token
+}
+
+func (f *fakeVRMAPI) setFail(fail bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.fail = fail
+}
+
+func TestVRMLoginCredentials(t *testing.T) {
+	api := &fakeVRMAPI{lifetime: time.Hour}
+	server := httptest.NewServer(api)
+	defer server.Close()
+
+	l := newVRMLogin(server.URL+"/", "user@example.com", "secret")
+
+	username, password := l.credentials()
+	logins, token := api.state()
+
+	if username != "user@example.com" || password != "Bearer "+token {
+		t.Errorf("credentials() = %q, %q, want user@example.com, Bearer %s", username, password, token)
+	}
+
+	// The token is reused until it is about to expire
+	l.credentials()
+
+	if n, _ := api.state(); n != logins {
+		t.Errorf("logged in %d times, want %d", n, logins)
+	}
+}
+
+func TestVRMLoginRefresh(t *testing.T) {
+	// Tokens expire within the refresh margin, so each use logs in again
+	api := &fakeVRMAPI{lifetime: vrmTokenRefreshMargin / 2}
+	server := httptest.NewServer(api)
+	defer server.Close()
+
+	l := newVRMLogin(server.URL, "user@example.com", "secret")
+
+	l.credentials()
+	_, password := l.credentials()
+	logins, token := api.state()
+
+	if logins != 2 {
+		t.Errorf("logged in %d times, want 2", logins)
+	}
+
+	if password != "Bearer "+token {
+		t.Errorf("credentials() password = %q, want the refreshed token", password)
+	}
+}
+
+func TestVRMLoginFailure(t *testing.T) {
+	api := &fakeVRMAPI{lifetime: vrmTokenRefreshMargin / 2}
+	server := httptest.NewServer(api)
+	defer server.Close()
+
+	l := newVRMLogin(server.URL, "user@example.com", "secret")
+
+	now := time.Now()
+
+	_, err := l.currentToken(now)
+	if err != nil {
+		t.Fatalf("currentToken() error = %v", err)
+	}
+
+	_, issued := api.state()
+	api.setFail(true)
+
+	// The previous token is kept while it is valid
+	token, err := l.currentToken(now)
+	if err == nil || token != issued {
+		t.Errorf("currentToken() = %q, %v, want the previous token and an error", token, err)
+	}
+
+	// but not once it has expired
+	token, err = l.currentToken(now.Add(time.Hour))
+	if err == nil || token != "" {
+		t.Errorf("currentToken() after expiry = %q, %v, want no token and an error", token, err)
+	}
+
+	// Without a valid token no bearer token is sent
+	_, password := newVRMLogin(server.URL, "user@example.com", "secret").credentials()
+	if password != "" {
+		t.Errorf("credentials() password = %q after failed login, want none", password)
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+)
+
+// Bounds on the wait between attempts to reconnect a subscription that
+// the watchdog disconnected, matching paho's own reconnect interval.
+const (
+	watchdogReconnectMinBackoff = time.Second
+	watchdogReconnectMaxBackoff = time.Minute
+)
+
+// watchdog detects subscriptions that appear connected but have stopped
+// delivering messages even though keepalive requests are being sent.
+type watchdog struct {
+	timeout time.Duration
+	// armedAt is when the first keepalive was sent since the last message
+	// was received, or the zero time if no keepalive is outstanding.
+	armedAt time.Time
+}
+
+// keepaliveSent records a keepalive request published at t.
+func (w *watchdog) keepaliveSent(t time.Time, lastMessage time.Time) {
+	if w.armedAt.IsZero() || lastMessage.After(w.armedAt) {
+		w.armedAt = t
+	}
+}
+
+// expired reports whether no message has been received within the
+// timeout since the first outstanding keepalive was sent.
+func (w *watchdog) expired(now time.Time, lastMessage time.Time) bool {
+	if w.timeout <= 0 || w.armedAt.IsZero() || lastMessage.After(w.armedAt) {
+		return false
+	}
+
+	return now.Sub(w.armedAt) >= w.timeout
+}
+
+func (w *watchdog) reset() {
+	w.armedAt = time.Time{}
+}
+
+// reconnectSubscription forces the subscription client to reconnect,
+// since paho only reconnects when it notices the connection has failed.
+// paho doesn't retry a connection that the exporter closed, so attempts
+// are repeated with backoff until one succeeds or ctx is done.
+func (s *site) reconnectSubscription(ctx context.Context) {
+	if !atomic.CompareAndSwapInt32(&s.reconnecting, 0, 1) {
+		s.logger().Debug("subscription reconnect already in progress")
+
+		return
+	}
+
+	s.logger().WithField("timeout", s.watchdog.timeout).Warn("no mqtt messages received since keepalive, forcing subscription reconnect")
+	watchdogReconnectsTotal.WithLabelValues(s.name).Inc()
+
+	sub := s.connection().sub
+	sub.Disconnect(250)
+	connections.set(s.name, s.subClientID, false)
+
+	go func() {
+		defer atomic.StoreInt32(&s.reconnecting, 0)
+
+		backoff := watchdogReconnectMinBackoff
+
+		for {
+			attemptCtx, cancel := context.WithTimeout(ctx, s.opts.connectTimeout)
+			err := connectWait(attemptCtx, sub, s.opts.connectTimeout)
+			cancel()
+
+			if err == nil {
+				connections.set(s.name, s.subClientID, true)
+
+				return
+			}
+
+			if ctx.Err() != nil {
+				return
+			}
+
+			s.logger().WithField("retry_in", backoff).WithError(err).Error("failed to reconnect mqtt subscription connection")
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(backoff):
+			}
+
+			backoff *= 2
+			if backoff > watchdogReconnectMaxBackoff {
+				backoff = watchdogReconnectMaxBackoff
+			}
+		}
+	}()
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestReconnectSubscriptionRetries(t *testing.T) {
+	server := newMQTTServer(nil)
+
+	var refuse, refused int32
+
+	server.acceptConnect = func(clientID string) bool {
+		if strings.HasSuffix(clientID, "_sub") && atomic.CompareAndSwapInt32(&refuse, 1, 0) {
+			atomic.AddInt32(&refused, 1)
+
+			return false
+		}
+
+		return true
+	}
+
+	s := newTestSite(t, "watchdog", startTestBroker(t, server))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	conn, err := s.connectBroker(ctx, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.disconnect()
+
+	s.switchConnection(conn)
+
+	atomic.StoreInt32(&refuse, 1)
+	s.reconnectSubscription(ctx)
+
+	if !waitFor(func() bool { return conn.sub.IsConnectionOpen() && atomic.LoadInt32(&s.reconnecting) == 0 }) {
+		t.Fatal("subscription did not reconnect after the first attempt was refused")
+	}
+
+	if atomic.LoadInt32(&refused) != 1 {
+		t.Errorf("refused %d reconnects, want 1", refused)
+	}
+
+	if !connections.connected(s.name, s.subClientID) {
+		t.Error("subscription connection state not restored")
+	}
+}
@@ -0,0 +1,323 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	log "github.com/sirupsen/logrus"
+)
+
+const writeAPIPrefix = "/api/v1/sites/"
+
+// writablePath is a path that may be changed through the write API, and
+// the values it accepts.
+type writablePath struct {
+	min float64
+	max float64
+	// integer rejects values with a fractional part
+	integer bool
+}
+
+// writablePaths is the allowlist of paths that the write API may change,
+// keyed by service and path.
+var writablePaths = map[string]writablePath{
+	// ESS grid setpoint in watts, negative to export
+	"settings/Settings/CGwacs/AcPowerSetPoint": {min: -100000, max: 100000},
+	// 1=Charger only; 2=Inverter only; 3=On; 4=Off
+	"vebus/Mode":                 {min: 1, max: 4, integer: true},
+	"vebus/Ac/In/1/CurrentLimit": {min: 0, max: 100},
+	"system/Relay/0/State":       {min: 0, max: 1, integer: true},
+}
+
+func (p writablePath) validate(value float64) error {
+	if math.IsNaN(value) || math.IsInf(value, 0) {
+		return errors.New("value must be a number")
+	}
+
+	if value < p.min || value > p.max {
+		return fmt.Errorf("value must be between %g and %g", p.min, p.max)
+	}
+
+	if p.integer && value != math.Trunc(value) {
+		return errors.New("value must be an integer")
+	}
+
+	return nil
+}
+
+// writableTopics returns the topics to subscribe to so that writes can
+// be confirmed.
+func writableTopics(prefix string) []string {
+	topics := make([]string, 0, len(writablePaths))
+
+	for key := range writablePaths {
+		parts := strings.SplitN(key, "/", 2)
+		topics = append(topics, prefix+parts[0]+"/+/"+parts[1])
+	}
+
+	return topics
+}
+
+// writeWaiters lets writes wait for the N/ update confirming them.
+type writeWaiters struct {
+	mu      sync.Mutex
+	waiters map[string][]chan []byte
+}
+
+// wait registers interest in updates to key, the topic without the N/
+// and portal ID. The returned function must be called when done.
+func (w *writeWaiters) wait(key string) (<-chan []byte, func()) {
+	ch := make(chan []byte, 1)
+
+	w.mu.Lock()
+	if w.waiters == nil {
+		w.waiters = map[string][]chan []byte{}
+	}
+	w.waiters[key] = append(w.waiters[key], ch)
+	w.mu.Unlock()
+
+	return ch, func() {
+		w.mu.Lock()
+		defer w.mu.Unlock()
+
+		waiters := w.waiters[key]
+		for i, c := range waiters {
+			if c == ch {
+				w.waiters[key] = append(waiters[:i], waiters[i+1:]...)
+
+				break
+			}
+		}
+
+		if len(w.waiters[key]) == 0 {
+			delete(w.waiters, key)
+		}
+	}
+}
+
+// notify passes an update to everything waiting on key. An update that
+// hasn't been received yet is replaced, so that a stale value can't hold
+// back the one confirming a write.
+func (w *writeWaiters) notify(key string, payload []byte) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	for _, ch := range w.waiters[key] {
+		select {
+		case <-ch:
+		default:
+		}
+
+		ch <- payload
+	}
+}
+
+type writeRequest struct {
+	Value *float64 `json:"value"`
+}
+
+type writeResponse struct {
+	Site  string  `json:"site"`
+	Topic string  `json:"topic"`
+	Value float64 `json:"value"`
+}
+
+type apiError struct {
+	Error string `json:"error"`
+}
+
+// newWriteAPIHandler handles PUT /api/v1/sites/{site}/{service}/{instance}/{path},
+// publishing the value in the JSON body to W/ and waiting up to timeout
+// for the GX to confirm it.
+func newWriteAPIHandler(sites func() []*site, token string, timeout time.Duration) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		fields := log.Fields{
+			"remote_addr": r.RemoteAddr,
+			"path":        r.URL.Path,
+		}
+
+		status, result := handleWrite(r, sites, token, timeout, fields)
+		fields["status"] = status
+
+		// Writes are logged at warning level so that the audit trail is
+		// kept at the default log level
+		log.WithFields(fields).Warn("api write")
+
+		writeJSON(w, status, result)
+	}
+}
+
+func handleWrite(r *http.Request, sites func() []*site, token string, timeout time.Duration, fields log.Fields) (int, interface{}) {
+	auth := r.Header.Get("Authorization")
+	if subtle.ConstantTimeCompare([]byte(auth), []byte("Bearer "+token)) != 1 {
+		return http.StatusUnauthorized, apiError{"invalid or missing bearer token"}
+	}
+
+	if r.Method != http.MethodPut {
+		return http.StatusMethodNotAllowed, apiError{"only PUT is supported"}
+	}
+
+	parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, writeAPIPrefix), "/", 4)
+	if len(parts) < 4 || parts[0] == "" || parts[1] == "" || parts[2] == "" || parts[3] == "" {
+		return http.StatusNotFound, apiError{"expected /api/v1/sites/{site}/{service}/{instance}/{path}"}
+	}
+
+	siteName, service, instance, path := parts[0], parts[1], parts[2], parts[3]
+
+	// The instance ends up in the W/ topic, where a wildcard would get the
+	// connection dropped by the broker
+	if !isNumber(instance) {
+		return http.StatusBadRequest, apiError{fmt.Sprintf("instance %q is not a device instance number", instance)}
+	}
+
+	allowed, ok := writablePaths[service+"/"+path]
+	if !ok {
+		return http.StatusForbidden, apiError{fmt.Sprintf("%s/%s is not writable", service, path)}
+	}
+
+	var req writeRequest
+
+	err := json.NewDecoder(io.LimitReader(r.Body, 1024)).Decode(&req)
+	if err != nil || req.Value == nil {
+		return http.StatusBadRequest, apiError{`expected a body of the form {"value": <number>}`}
+	}
+
+	value := *req.Value
+	fields["value"] = value
+
+	err = allowed.validate(value)
+	if err != nil {
+		return http.StatusBadRequest, apiError{err.Error()}
+	}
+
+	var s *site
+
+	for _, candidate := range sites() {
+		if candidate.name == siteName {
+			s = candidate
+		}
+	}
+
+	if s == nil {
+		return http.StatusNotFound, apiError{fmt.Sprintf("unknown site %q", siteName)}
+	}
+
+	fields["site"] = s.name
+
+	ctx, cancel := context.WithTimeout(r.Context(), timeout)
+	defer cancel()
+
+	topic, err := s.write(ctx, service+"/"+instance+"/"+path, value)
+	if err != nil {
+		fields[log.ErrorKey] = err
+
+		switch {
+		case errors.Is(err, errWriteUnavailable):
+			return http.StatusServiceUnavailable, apiError{err.Error()}
+		case errors.Is(err, context.DeadlineExceeded):
+			return http.StatusGatewayTimeout, apiError{"timed out waiting for the GX to confirm the write"}
+		default:
+			return http.StatusBadGateway, apiError{err.Error()}
+		}
+	}
+
+	return http.StatusOK, writeResponse{Site: s.name, Topic: topic, Value: value}
+}
+
+var errWriteUnavailable = errors.New("site is not connected")
+
+// write publishes value to the W/ topic for key, the service, instance
+// and path, and waits until the GX publishes the same value back.
+func (s *site) write(ctx context.Context, key string, value float64) (string, error) {
+	portalID := s.portal.get()
+	conn := s.connection()
+
+	if portalID == "" || conn == nil || !conn.pub.IsConnectionOpen() || !conn.sub.IsConnectionOpen() {
+		return "", errWriteUnavailable
+	}
+
+	confirmed, done := s.writes.wait(key)
+	defer done()
+
+	payload, err := json.Marshal(writeRequest{Value: &value})
+	if err != nil {
+		return "", err
+	}
+
+	topic := "W/" + portalID + "/" + key
+
+	err = publishWrite(ctx, conn.pub, portalID, key, payload)
+	if err != nil {
+		return topic, err
+	}
+
+	for {
+		select {
+		case payload := <-confirmed:
+			if writeConfirmed(payload, value) {
+				return topic, nil
+			}
+		case <-ctx.Done():
+			return topic, ctx.Err()
+		}
+	}
+}
+
+// publishWrite publishes payload to the W/ topic for key, then asks for
+// key to be read back. The GX only publishes values that change, so the
+// read-back confirms a write of the value the path already has.
+func publishWrite(ctx context.Context, client mqtt.Client, portalID string, key string, payload []byte) error {
+	for _, p := range []struct {
+		topic   string
+		payload []byte
+	}{
+		{"W/" + portalID + "/" + key, payload},
+		{"R/" + portalID + "/" + key, nil},
+	} {
+		token := client.Publish(p.topic, 1, false, p.payload)
+		select {
+		case <-token.Done():
+			if token.Error() != nil {
+				return token.Error()
+			}
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	return nil
+}
+
+// writeConfirmed reports whether an N/ payload holds the written value.
+// The GX stores some values as float32 and publishes them back rounded,
+// for example 233.74000549316406 for 233.74, so numbers are compared
+// with a relative tolerance.
+func writeConfirmed(payload []byte, value interface{}) bool {
+	var v struct {
+		Value interface{} `json:"value"`
+	}
+
+	if json.Unmarshal(payload, &v) != nil {
+		return false
+	}
+
+	got, gotNumber := v.Value.(float64)
+	want, wantNumber := value.(float64)
+
+	if gotNumber && wantNumber {
+		return math.Abs(got-want) <= 1e-6*math.Max(1, math.Max(math.Abs(got), math.Abs(want)))
+	}
+
+	return reflect.DeepEqual(v.Value, value)
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+func TestWriteConfirmed(t *testing.T) {
+	tests := []struct {
+		payload string
+		value   interface{}
+		want    bool
+	}{
+		{`{"value": 233.74}`, 233.74, true},
+		// Values stored as float32 are published back rounded
+		{`{"value": 233.74000549316406}`, 233.74, true},
+		{`{"value": -500.29998779296875}`, -500.3, true},
+		{`{"value": 0}`, 0.0, true},
+		{`{"value": 233.75}`, 233.74, false},
+		{`{"value": 1e-7}`, 0.0, true},
+		{`{"value": "on"}`, "on", true},
+		{`{"value": "on"}`, "off", false},
+		{`{"value": [1, 2]}`, []interface{}{1.0, 2.0}, true},
+		{`{"value": null}`, 1.0, false},
+		{`not json`, 1.0, false},
+	}
+
+	for _, tt := range tests {
+		got := writeConfirmed([]byte(tt.payload), tt.value)
+		if got != tt.want {
+			t.Errorf("writeConfirmed(%s, %v) = %t, want %t", tt.payload, tt.value, got, tt.want)
+		}
+	}
+}
+
+// TestPublishWriteUnchangedValue checks that writing the value a path
+// already has is confirmed by the read-back.
+func TestPublishWriteUnchangedValue(t *testing.T) {
+	sim := newSimulator("c0619ab12345", time.Now(), 1)
+	url := startTestBroker(t, sim.server)
+
+	opts := mqtt.NewClientOptions().AddBroker(url).SetClientID("write-test")
+	client := mqtt.NewClient(opts)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	err := connectWait(ctx, client, 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Disconnect(250)
+
+	confirmed := make(chan bool, 10)
+
+	token := client.Subscribe("N/c0619ab12345/vebus/276/Mode", 0, func(client mqtt.Client, msg mqtt.Message) {
+		confirmed <- writeConfirmed(msg.Payload(), 3.0)
+	})
+	token.Wait()
+
+	err = publishWrite(ctx, client, "c0619ab12345", "vebus/276/Mode", []byte(`{"value": 3}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for {
+		select {
+		case ok := <-confirmed:
+			if ok {
+				return
+			}
+		case <-ctx.Done():
+			t.Fatal("write of the current value was not confirmed")
+		}
+	}
+}
+
+func TestWriteWaitersNotifyReplacesStale(t *testing.T) {
+	var w writeWaiters
+
+	ch, done := w.wait("vebus/276/Mode")
+	defer done()
+
+	w.notify("vebus/276/Mode", []byte(`{"value": 2}`))
+	w.notify("vebus/276/Mode", []byte(`{"value": 3}`))
+
+	if got := string(<-ch); got != `{"value": 3}` {
+		t.Errorf("received %s, want the latest update", got)
+	}
+}
+
+func TestWriteAPIHandler(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	sim := newSimulator("c0619ab12345", time.Now(), 1)
+	url := startTestBroker(t, sim.server)
+
+	go sim.run(ctx)
+
+	s := newTestSite(t, "write", url)
+	s.opts.writeAPI = true
+
+	go func() { _ = s.run(ctx) }()
+
+	if !waitFor(func() bool { return s.portal.get() != "" }) {
+		t.Fatal("site did not find the portal ID")
+	}
+
+	handler := newWriteAPIHandler(func() []*site { return []*site{s} }, "secret", 500*time.Millisecond)
+
+	tests := []struct {
+		name   string
+		token  string
+		path   string
+		body   string
+		status int
+	}{
+		{"no token", "", "write/vebus/276/Mode", `{"value": 1}`, http.StatusUnauthorized},
+		{"wrong token", "wrong", "write/vebus/276/Mode", `{"value": 1}`, http.StatusUnauthorized},
+		{"read-only path", "secret", "write/battery/512/Soc", `{"value": 1}`, http.StatusForbidden},
+		{"wildcard instance", "secret", "write/vebus/+/Mode", `{"value": 1}`, http.StatusBadRequest},
+		{"out of range", "secret", "write/vebus/276/Mode", `{"value": 5}`, http.StatusBadRequest},
+		{"not an integer", "secret", "write/vebus/276/Mode", `{"value": 1.5}`, http.StatusBadRequest},
+		{"missing value", "secret", "write/vebus/276/Mode", `{}`, http.StatusBadRequest},
+		{"unknown site", "secret", "other/vebus/276/Mode", `{"value": 1}`, http.StatusNotFound},
+		// The simulator ignores writes to devices it doesn't have
+		{"unconfirmed", "secret", "write/vebus/999/Mode", `{"value": 1}`, http.StatusGatewayTimeout},
+		{"success", "secret", "write/vebus/276/Mode", `{"value": 1}`, http.StatusOK},
+		{"unchanged value", "secret", "write/vebus/276/Mode", `{"value": 1}`, http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodPut, writeAPIPrefix+tt.path, strings.NewReader(tt.body))
+		if tt.token != "" {
+			req.Header.Set("Authorization", "Bearer "+tt.token)
+		}
+
+		rec := httptest.NewRecorder()
+		handler(rec, req)
+
+		if rec.Code != tt.status {
+			t.Errorf("%s: PUT %s = %d %s, want %d", tt.name, tt.path, rec.Code, strings.TrimSpace(rec.Body.String()), tt.status)
+		}
+	}
+}